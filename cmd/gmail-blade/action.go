@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Action types, which are also the shorthand forms of actions without
+// arguments.
+const (
+	actionDelete        = "delete"
+	actionArchive       = "archive"
+	actionArchiveThread = "archive thread"
+	actionMuteThread    = "mute thread"
+	actionLabel         = "label"
+	actionUnlabel       = "unlabel"
+	actionMoveTo        = "move to"
+	actionMarkRead      = "mark read"
+	actionMarkUnread    = "mark unread"
+	actionStar          = "star"
+	actionUnstar        = "unstar"
+	actionMarkImportant = "mark important"
+	actionNotImportant  = "not important"
+	actionGitHubReview  = "github review"
+
+	actionSaveAttachmentsTo = "save attachments to"
+)
+
+// actionsWithoutArguments are the action types that take no arguments.
+var actionsWithoutArguments = []string{
+	actionDelete,
+	actionArchive,
+	actionArchiveThread,
+	actionMuteThread,
+	actionMarkRead,
+	actionMarkUnread,
+	actionStar,
+	actionUnstar,
+	actionMarkImportant,
+	actionNotImportant,
+	actionGitHubReview,
+}
+
+// actionsWithArguments are the action types that take an argument, which is
+// quoted in their shorthand forms, e.g. `label "GitHub"`.
+var actionsWithArguments = []string{
+	actionLabel,
+	actionUnlabel,
+	actionMoveTo,
+	actionSaveAttachmentsTo,
+}
+
+// configAction is an action of a filter, which is either the string shorthand,
+// e.g. `label "GitHub"`, or a map, e.g. `{type: label, name: GitHub}`.
+type configAction struct {
+	Type    string `yaml:"type"`
+	Name    string `yaml:"name"`    // The label name of "label" and "unlabel" actions
+	Mailbox string `yaml:"mailbox"` // The mailbox name of "move to" actions
+	Path    string `yaml:"path"`    // The path template of "save attachments to" actions
+
+	// pathTemplate is the parsed Path.
+	pathTemplate *template.Template
+	// dir is the directory of the file defining the action, which relative
+	// local paths are resolved against.
+	dir string
+
+	// shorthand is the string form as written in the config, parsed into the
+	// fields above by parse.
+	shorthand string
+}
+
+func (a *configAction) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&a.shorthand)
+	}
+
+	type plain configAction
+	var p plain
+	err := node.Decode(&p)
+	if err != nil {
+		return err
+	}
+	*a = configAction(p)
+	return nil
+}
+
+var (
+	labelRegexp        = regexp.MustCompile(`^label "([^"]*)"$`)
+	unlabelRegexp      = regexp.MustCompile(`^unlabel "([^"]*)"$`)
+	moveToRegexp       = regexp.MustCompile(`^move to "([^"]*)"$`)
+	githubReviewRegexp = regexp.MustCompile(`(?i)^github\s+review$`)
+
+	saveAttachmentsToRegexp = regexp.MustCompile(`^save attachments to "([^"]*)"$`)
+)
+
+// parse parses the shorthand form if any, and validates the action.
+func (a *configAction) parse() error {
+	if a.shorthand != "" {
+		action := strings.TrimSpace(a.shorthand)
+		if match := labelRegexp.FindStringSubmatch(action); match != nil {
+			a.Type, a.Name = actionLabel, match[1]
+		} else if match = unlabelRegexp.FindStringSubmatch(action); match != nil {
+			a.Type, a.Name = actionUnlabel, match[1]
+		} else if match = moveToRegexp.FindStringSubmatch(action); match != nil {
+			a.Type, a.Mailbox = actionMoveTo, match[1]
+		} else if match = saveAttachmentsToRegexp.FindStringSubmatch(action); match != nil {
+			a.Type, a.Path = actionSaveAttachmentsTo, match[1]
+		} else if githubReviewRegexp.MatchString(action) {
+			a.Type = actionGitHubReview
+		} else {
+			a.Type = action
+		}
+	}
+
+	switch a.Type {
+	case actionLabel, actionUnlabel:
+		if a.Name == "" {
+			return errors.Errorf("%s action requires a label name", a.Type)
+		}
+	case actionMoveTo:
+		if a.Mailbox == "" {
+			return errors.Errorf("%s action requires a mailbox", a.Type)
+		}
+	case actionSaveAttachmentsTo:
+		if a.Path == "" {
+			return errors.Errorf("%s action requires a path", a.Type)
+		}
+		tmpl, err := template.New("path").Option("missingkey=error").Parse(a.Path)
+		if err != nil {
+			return errors.Wrap(err, "parse path template")
+		}
+		// Unknown fields only fail when executed, e.g. "{{.Sender_Domain}}".
+		err = tmpl.Execute(io.Discard, attachmentPathData{})
+		if err != nil {
+			return errors.Wrap(err, "check path template")
+		}
+		a.pathTemplate = tmpl
+	case "":
+		return errors.New("action type cannot be empty")
+	default:
+		if slices.Contains(actionsWithoutArguments, a.Type) {
+			return nil
+		}
+		if a.shorthand != "" {
+			return errors.Errorf("unknown action %q", a.shorthand)
+		}
+		return errors.Errorf("unknown action type %q", a.Type)
+	}
+	return nil
+}
+
+// String returns the action in its shorthand form.
+func (a configAction) String() string {
+	switch a.Type {
+	case actionLabel, actionUnlabel:
+		return fmt.Sprintf(`%s "%s"`, a.Type, a.Name)
+	case actionMoveTo:
+		return fmt.Sprintf(`%s "%s"`, a.Type, a.Mailbox)
+	case actionSaveAttachmentsTo:
+		return fmt.Sprintf(`%s "%s"`, a.Type, a.Path)
+	default:
+		return a.Type
+	}
+}
+
+// removesFromMailbox returns true if the action takes the message out of the
+// mailbox it is processed in, after which its flags and labels can no longer be
+// changed by the UID.
+func (a configAction) removesFromMailbox() bool {
+	switch a.Type {
+	case actionDelete, actionMoveTo, actionArchive, actionArchiveThread, actionMuteThread:
+		return true
+	}
+	return false
+}
+
+// orderActions returns the actions with the ones removing the message from the
+// mailbox moved to the end, e.g. `[archive, mark read]` runs as `[mark read,
+// archive]`. The order is kept otherwise.
+func orderActions(actions []configAction) []configAction {
+	ordered := make([]configAction, 0, len(actions))
+	var removing []configAction
+	for _, action := range actions {
+		if action.removesFromMailbox() {
+			removing = append(removing, action)
+		} else {
+			ordered = append(ordered, action)
+		}
+	}
+	return append(ordered, removing...)
+}
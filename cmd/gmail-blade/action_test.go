@@ -0,0 +1,54 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestOrderActions(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []string
+		want    []string
+	}{
+		{
+			name:    "flag after archive",
+			actions: []string{`archive`, `mark read`},
+			want:    []string{`mark read`, `archive`},
+		},
+		{
+			name:    "labels and flags around delete",
+			actions: []string{`label "A"`, `delete`, `star`, `label "B"`},
+			want:    []string{`label "A"`, `star`, `label "B"`, `delete`},
+		},
+		{
+			name:    "removing actions keep their order",
+			actions: []string{`move to "Spam"`, `mark read`, `archive thread`},
+			want:    []string{`mark read`, `move to "Spam"`, `archive thread`},
+		},
+		{
+			name:    "already ordered",
+			actions: []string{`mark read`, `archive`},
+			want:    []string{`mark read`, `archive`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actions := make([]configAction, len(test.actions))
+			for i, shorthand := range test.actions {
+				actions[i] = configAction{shorthand: shorthand}
+				if err := actions[i].parse(); err != nil {
+					t.Fatalf("parse %q: %v", shorthand, err)
+				}
+			}
+
+			var got []string
+			for _, action := range orderActions(actions) {
+				got = append(got, action.String())
+			}
+			if !slices.Equal(got, test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
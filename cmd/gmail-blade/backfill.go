@@ -0,0 +1,219 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/pkg/errors"
+)
+
+// backfillOptions selects the historical messages to run the filters over.
+type backfillOptions struct {
+	Account     string `json:"account"`
+	Mailbox     string `json:"mailbox"`
+	Since       string `json:"since"`  // In backfillDateLayout, inclusive
+	Before      string `json:"before"` // In backfillDateLayout, exclusive
+	Search      string `json:"search"` // The Gmail search query
+	IncludeRead bool   `json:"include_read"`
+}
+
+const backfillDateLayout = "2006-01-02"
+
+// backfillState is the progress of a backfill, which is saved to the state file
+// after every processed message to resume after interruption.
+type backfillState struct {
+	Options backfillOptions `json:"options"`
+	// LastUID is the highest processed UID, messages are processed in ascending
+	// order of UIDs.
+	LastUID imap.UID `json:"last_uid"`
+}
+
+// loadBackfillState returns the saved state of the backfill with the same
+// options, or a new state when the state file does not exist.
+func loadBackfillState(path string, options backfillOptions) (*backfillState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &backfillState{Options: options}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "read state file")
+	}
+
+	var state backfillState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse state file")
+	}
+	if state.Options != options {
+		return nil, errors.Errorf("state file %q belongs to a backfill with different options, remove it to start over", path)
+	}
+	return &state, nil
+}
+
+func (s *backfillState) save(path string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that an interruption never leaves a
+	// truncated state file behind.
+	err = os.WriteFile(path+".tmp", data, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// runBackfill runs the filters over the messages of the mailbox selected by the
+// options. Unlike processMailbox, the highest processed UID in the cache is
+// neither used nor advanced. Unless dryRun is true, the progress is saved to the
+// state file so that running the same backfill again resumes where it stopped,
+// and the state file is removed once done.
+func runBackfill(logger Logger, ctx context.Context, dryRun bool, config *config, account *configAccount, checkpoint *checkpoint, options backfillOptions, stateFile string) error {
+	state, err := loadBackfillState(stateFile, options)
+	if err != nil {
+		return err
+	}
+	if state.LastUID > 0 {
+		logger.Info("Resuming backfill", "stateFile", stateFile, "lastUID", state.LastUID)
+	}
+
+	client, closeClient, err := getAuthenticatedClient(account.IMAP, account.Credentials, &imapclient.Options{})
+	if err != nil {
+		return errors.Wrap(err, "get authenticated IMAP client")
+	}
+	defer closeClient()
+
+	gmail := newGmailClientIfSupported(client, account)
+	defer func() { _ = gmail.Close() }()
+
+	mailbox := options.Mailbox
+	_, err = client.Select(
+		mailbox,
+		&imap.SelectOptions{
+			ReadOnly: dryRun,
+		},
+	).Wait()
+	if err != nil {
+		return errors.Wrap(err, "select mailbox")
+	}
+
+	// Dates are validated by the command.
+	criteria := &imap.SearchCriteria{}
+	if options.Since != "" {
+		criteria.Since, _ = time.Parse(backfillDateLayout, options.Since)
+	}
+	if options.Before != "" {
+		criteria.Before, _ = time.Parse(backfillDateLayout, options.Before)
+	}
+	if state.LastUID > 0 {
+		uidRange := imap.UIDSet{}
+		uidRange.AddRange(state.LastUID+1, 0)
+		criteria.UID = []imap.UIDSet{uidRange}
+	}
+	if !options.IncludeRead {
+		criteria.NotFlag = []imap.Flag{imap.FlagSeen}
+	}
+	searchData, err := client.UIDSearch(criteria, nil).Wait()
+	if err != nil {
+		return errors.Wrap(err, "search messages")
+	}
+	// See processMailbox for why "n:*" may match the UID before n.
+	messageUIDs := slices.DeleteFunc(searchData.AllUIDs(), func(uid imap.UID) bool {
+		return uid <= state.LastUID
+	})
+
+	if options.Search != "" {
+		if gmail == nil {
+			return errors.Errorf("search requires an IMAP server with the %s extension", gmailCapability)
+		}
+		uids, err := gmail.searchRaw(mailbox, state.LastUID, !options.IncludeRead, options.Search)
+		if err != nil {
+			return errors.Wrapf(err, "search messages matching %q", options.Search)
+		}
+		matches := make(map[imap.UID]struct{}, len(uids))
+		for _, uid := range uids {
+			matches[uid] = struct{}{}
+		}
+		messageUIDs = slices.DeleteFunc(messageUIDs, func(uid imap.UID) bool {
+			_, ok := matches[uid]
+			return !ok
+		})
+	}
+
+	searches, err := searchFilters(gmail, account, mailbox, state.LastUID, !options.IncludeRead)
+	if err != nil {
+		return err
+	}
+	messageUIDs = searches.narrow(messageUIDs)
+	slices.Sort(messageUIDs)
+
+	logger.Info("Backfilling messages", "mailbox", mailbox, "total", len(messageUIDs), "dryRun", dryRun)
+	var processed int
+	for idx := 0; idx < len(messageUIDs); idx += 100 {
+		end := min(idx+100, len(messageUIDs))
+		uidSet := imap.UIDSetNum(messageUIDs[idx:end]...)
+		messages, err := client.Fetch(uidSet, messageFetchOptions()).Collect()
+		if err != nil {
+			return errors.Wrap(err, "fetch messages")
+		}
+		slices.SortFunc(messages, func(a, b *imapclient.FetchMessageBuffer) int {
+			return cmp.Compare(a.UID, b.UID)
+		})
+
+		var gmailAttrs map[imap.UID]gmailAttributes
+		if gmail != nil {
+			gmailAttrs, err = gmail.fetchAttributes(mailbox, messageUIDs[idx:end])
+			if err != nil {
+				return errors.Wrap(err, "fetch Gmail attributes")
+			}
+		}
+
+		for _, msg := range messages {
+			// Stop between messages, so that the state file points to the last
+			// message whose actions have all been run.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			m, err := newMessage(msg, gmailAttrs[msg.UID])
+			if err != nil {
+				return errors.Wrapf(err, "uid %d", msg.UID)
+			}
+			m.searchMatches = searches.queries(msg.UID)
+			// The mute list is only read, writing the cached checkpoint could
+			// overwrite highest UIDs advanced by a running server meanwhile.
+			err = processMessage(logger, ctx, dryRun, config, account, client, gmail, nil, checkpoint, mailbox, m)
+			if err != nil {
+				return errors.Wrapf(err, "uid %d", msg.UID)
+			}
+
+			if !dryRun {
+				state.LastUID = msg.UID
+				err = state.save(stateFile)
+				if err != nil {
+					return errors.Wrap(err, "save state file")
+				}
+			}
+		}
+
+		processed += len(messages)
+		logger.Info("Backfill progress", "mailbox", mailbox, "processed", processed, "total", len(messageUIDs))
+	}
+
+	if !dryRun {
+		err = os.Remove(stateFile)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove state file")
+		}
+	}
+	logger.Info("Backfill completed", "mailbox", mailbox, "processed", processed)
+	return nil
+}
@@ -6,7 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"net/url"
+	"slices"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
@@ -22,6 +25,7 @@ type cloudflareKVCache struct {
 	accountID   string
 	namespaceID string
 	apiToken    string
+	key         string
 	baseURL     string
 	httpClient  *http.Client
 }
@@ -29,7 +33,51 @@ type cloudflareKVCache struct {
 type cloudflareKVCacheValue struct {
 	CachedAt     time.Time `json:"cached_at"`
 	IMAPUsername string    `json:"imap_username"`
-	IMAPUID      imap.UID  `json:"imap_uid"`
+	// IMAPUID is the highest processed UID of the INBOX, it is kept for values
+	// written before multiple mailboxes were supported.
+	IMAPUID imap.UID `json:"imap_uid"`
+	// Mailboxes is the highest processed UID of each mailbox.
+	Mailboxes map[string]imap.UID `json:"mailboxes,omitempty"`
+	// MutedThreads is the Gmail thread IDs muted by the "mute thread" action.
+	MutedThreads []string `json:"muted_threads,omitempty"`
+}
+
+// checkpoint is the processing state of an account, which is persisted in the
+// cache across restarts.
+type checkpoint struct {
+	// HighestUIDs is the highest processed UID of each mailbox, keyed by the
+	// mailbox name.
+	HighestUIDs map[string]imap.UID
+	// MutedThreads is the muted Gmail thread IDs, oldest first.
+	MutedThreads []string
+}
+
+func newCheckpoint() *checkpoint {
+	return &checkpoint{HighestUIDs: make(map[string]imap.UID)}
+}
+
+func (c *checkpoint) clone() *checkpoint {
+	return &checkpoint{
+		HighestUIDs:  maps.Clone(c.HighestUIDs),
+		MutedThreads: slices.Clone(c.MutedThreads),
+	}
+}
+
+// maxMutedThreads is the maximum number of muted threads to keep, the oldest
+// ones are dropped first.
+const maxMutedThreads = 1000
+
+// muteThread adds the thread ID to the muted threads, and reports whether it
+// was not muted yet.
+func (c *checkpoint) muteThread(threadID string) bool {
+	if slices.Contains(c.MutedThreads, threadID) {
+		return false
+	}
+	c.MutedThreads = append(c.MutedThreads, threadID)
+	if len(c.MutedThreads) > maxMutedThreads {
+		c.MutedThreads = slices.Clone(c.MutedThreads[len(c.MutedThreads)-maxMutedThreads:])
+	}
+	return true
 }
 
 type cloudflareKVErrorResponse struct {
@@ -46,59 +94,73 @@ func newCloudflareKVCache(config configCloudflareKV) *cloudflareKVCache {
 		accountID:   config.AccountID,
 		namespaceID: config.NamespaceID,
 		apiToken:    config.APIToken,
+		key:         config.Key,
 		baseURL:     cloudflareAPIURL,
 		httpClient:  &http.Client{Timeout: 30 * time.Second},
 	}
 }
 
-func (c *cloudflareKVCache) highestUID(ctx context.Context, imapUsername string) (imap.UID, error) {
+// checkpoint returns the stored checkpoint, or an empty one if there is none.
+func (c *cloudflareKVCache) checkpoint(ctx context.Context, imapUsername string) (*checkpoint, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.valueURL(), nil)
 	if err != nil {
-		return 0, errors.Wrap(err, "create request")
+		return nil, errors.Wrap(err, "create request")
 	}
 	req.Header.Set("Authorization", "Bearer "+c.apiToken)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return 0, errors.Wrap(err, "send request")
+		return nil, errors.Wrap(err, "send request")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound {
 		body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
 		if err != nil {
-			return 0, errors.Wrap(err, "read not found response")
+			return nil, errors.Wrap(err, "read not found response")
 		}
 		var errorResponse cloudflareKVErrorResponse
 		if err := json.Unmarshal(body, &errorResponse); err != nil {
-			return 0, errors.Wrap(err, "decode not found response")
+			return nil, errors.Wrap(err, "decode not found response")
 		}
 		for _, apiError := range errorResponse.Errors {
 			if apiError.Code == 10009 {
-				return 0, nil
+				return newCheckpoint(), nil
 			}
 		}
-		return 0, errors.Errorf("unexpected response status %s: %s", resp.Status, body)
+		return nil, errors.Errorf("unexpected response status %s: %s", resp.Status, body)
 	}
 	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
-		return 0, cloudflareKVResponseError(resp)
+		return nil, cloudflareKVResponseError(resp)
 	}
 
 	var value cloudflareKVCacheValue
 	if err := json.NewDecoder(resp.Body).Decode(&value); err != nil {
-		return 0, errors.Wrap(err, "decode value")
+		return nil, errors.Wrap(err, "decode value")
 	}
 	if value.IMAPUsername != imapUsername {
-		return 0, nil
+		return newCheckpoint(), nil
+	}
+	if value.Mailboxes == nil {
+		value.Mailboxes = make(map[string]imap.UID)
+	}
+	if _, ok := value.Mailboxes["INBOX"]; !ok && value.IMAPUID > 0 {
+		value.Mailboxes["INBOX"] = value.IMAPUID
 	}
-	return value.IMAPUID, nil
+	return &checkpoint{
+		HighestUIDs:  value.Mailboxes,
+		MutedThreads: value.MutedThreads,
+	}, nil
 }
 
-func (c *cloudflareKVCache) put(ctx context.Context, imapUsername string, uid imap.UID) error {
+// put stores the checkpoint.
+func (c *cloudflareKVCache) put(ctx context.Context, imapUsername string, checkpoint *checkpoint) error {
 	data, err := json.Marshal(cloudflareKVCacheValue{
 		CachedAt:     time.Now().UTC(),
 		IMAPUsername: imapUsername,
-		IMAPUID:      uid,
+		IMAPUID:      checkpoint.HighestUIDs["INBOX"],
+		Mailboxes:    checkpoint.HighestUIDs,
+		MutedThreads: checkpoint.MutedThreads,
 	})
 	if err != nil {
 		return errors.Wrap(err, "marshal value")
@@ -130,7 +192,7 @@ func (c *cloudflareKVCache) valueURL() string {
 		c.baseURL,
 		c.accountID,
 		c.namespaceID,
-		cloudflareKVHighestUIDKey,
+		url.PathEscape(c.key),
 	)
 }
 
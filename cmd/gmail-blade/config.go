@@ -1,34 +1,136 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
-	"syscall"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/file"
 	"github.com/expr-lang/expr/vm"
 	"github.com/pkg/errors"
-	"golang.org/x/term"
+	"golang.org/x/oauth2"
 	"gopkg.in/yaml.v3"
 )
 
 type config struct {
 	Credentials configCredentials `yaml:"credentials"`
+	Accounts    []configAccount   `yaml:"accounts"`
 	Server      configServer      `yaml:"server"`
 	Cache       configCache       `yaml:"cache"`
 	GitHub      configGitHub      `yaml:"github"`
 	Slack       configSlack       `yaml:"slack"`
+	Storage     configStorage     `yaml:"storage"`
+	Mailboxes   []string          `yaml:"mailboxes"`
+	Search      string            `yaml:"search"`
 	Filters     []configFilter    `yaml:"filters"`
+	// Include is the glob patterns of files to merge definitions and filters
+	// from, relative to the config file, see configFragment.
+	Include []string `yaml:"include"`
+	// Definitions are named sub-expressions and constant lists that conditions
+	// can reference by their names.
+	Definitions map[string]configDefinition `yaml:"definitions"`
+
+	// dir is the directory of the config file, which relative paths in the config
+	// are resolved against.
+	dir string
+	// fragment is set when an included file is validated on its own, where
+	// integrations like GitHub and S3 are configured by the including file.
+	fragment bool
+}
+
+// configAccount is an IMAP account to process. Any of the IMAP server, cache,
+// mailboxes, search and filters that is not set for the account falls back to the
+// top-level one. When no accounts are configured, the top-level credentials are
+// used as the only account.
+type configAccount struct {
+	Name        string            `yaml:"name"`
+	Credentials configCredentials `yaml:"credentials"`
+	IMAP        configIMAP        `yaml:"imap"`
+	Cache       configCache       `yaml:"cache"`
+	Mailboxes   []string          `yaml:"mailboxes"`
+	Search      string            `yaml:"search"` // The Gmail search query of candidate messages, instead of unread messages
+	Filters     []configFilter    `yaml:"filters"`
+	// Include is the glob patterns of files to merge filters of the account
+	// from, relative to the config file, see includeConfigFiles.
+	Include []string `yaml:"include"`
 }
 
 type configCredentials struct {
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Username string       `yaml:"username"`
+	Password string       `yaml:"password"`
+	OAuth2   configOAuth2 `yaml:"oauth2"`
+}
+
+type configOAuth2 struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RefreshToken string `yaml:"refresh_token"`
+	TokenFile    string `yaml:"token_file"`
+	TokenURL     string `yaml:"token_url"`
+
+	// tokenSource is shared by all copies of the config, so that the access
+	// token is only refreshed once it expires.
+	tokenSource oauth2.TokenSource
+}
+
+func (c configOAuth2) enabled() bool {
+	return c.ClientID != "" || c.ClientSecret != "" || c.RefreshToken != "" || c.TokenFile != ""
 }
 
 type configServer struct {
-	SleepInterval string `yaml:"sleep_interval"`
+	SleepInterval string     `yaml:"sleep_interval"`
+	Idle          bool       `yaml:"idle"`
+	IMAP          configIMAP `yaml:"imap"`
+}
+
+const (
+	imapSecurityTLS      = "tls"
+	imapSecurityStartTLS = "starttls"
+	imapSecurityPlain    = "plain"
+)
+
+type configIMAP struct {
+	Host               string `yaml:"host"`
+	Port               int    `yaml:"port"`
+	Security           string `yaml:"security"`
+	CAFile             string `yaml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	TrashMailbox       string `yaml:"trash_mailbox"`
+	ArchiveMailbox     string `yaml:"archive_mailbox"`
+}
+
+// address returns the "host:port" address of the IMAP server.
+func (c configIMAP) address() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// tlsConfig returns the TLS configuration for connecting to the IMAP server.
+func (c configIMAP) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.Host,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read CA file")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in CA file %q", c.CAFile)
+		}
+	}
+	return tlsConfig, nil
 }
 
 type configCache struct {
@@ -39,6 +141,7 @@ type configCloudflareKV struct {
 	AccountID   string `yaml:"account_id"`
 	NamespaceID string `yaml:"namespace_id"`
 	APIToken    string `yaml:"api_token"`
+	Key         string `yaml:"key"`
 }
 
 func (c configCloudflareKV) enabled() bool {
@@ -61,35 +164,127 @@ type configSlack struct {
 	SendLogLevel string `yaml:"send_log_level"`
 }
 
+type configStorage struct {
+	S3 configS3 `yaml:"s3"`
+}
+
+// configS3 is an S3-compatible storage, e.g. AWS S3 or MinIO.
+type configS3 struct {
+	Endpoint        string `yaml:"endpoint"`
+	Region          string `yaml:"region"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	PathStyle       bool   `yaml:"path_style"`
+}
+
+func (c configS3) enabled() bool {
+	return c.AccessKeyID != "" || c.SecretAccessKey != ""
+}
+
+// validate resolves the credentials, checks that all required fields are set,
+// and sets the default region and endpoint.
+func (c *configS3) validate(secrets secretResolver) error {
+	var err error
+	c.AccessKeyID, err = secrets.resolve(c.AccessKeyID)
+	if err != nil {
+		return errors.Wrap(err, "resolve storage.s3.access_key_id")
+	}
+	c.SecretAccessKey, err = secrets.resolve(c.SecretAccessKey)
+	if err != nil {
+		return errors.Wrap(err, "resolve storage.s3.secret_access_key")
+	}
+	if !c.enabled() {
+		return nil
+	}
+
+	if c.AccessKeyID == "" {
+		return errors.New("storage.s3.access_key_id cannot be empty")
+	}
+	if c.SecretAccessKey == "" {
+		return errors.New("storage.s3.secret_access_key cannot be empty")
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = "https://s3." + c.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return errors.Errorf("invalid storage.s3.endpoint %q", c.Endpoint)
+	}
+	return nil
+}
+
 type configFilter struct {
-	Name              string      `yaml:"name"`
-	Prefetches        []string    `yaml:"prefetches"`
-	Condition         string      `yaml:"condition"`
-	CompiledCondition *vm.Program `yaml:"-"`
-	Actions           []string    `yaml:"actions"`
-	HaltOnMatch       bool        `yaml:"halt-on-match"`
+	Name              string             `yaml:"name"`
+	Mailboxes         []string           `yaml:"mailboxes"`
+	Search            string             `yaml:"search"` // The Gmail search query that messages must also match
+	Prefetches        []string           `yaml:"prefetches"`
+	Condition         string             `yaml:"condition"`
+	CompiledCondition *vm.Program        `yaml:"-"`
+	Actions           []configAction     `yaml:"actions"`
+	HaltOnMatch       bool               `yaml:"halt-on-match"`
+	Tests             []configFilterTest `yaml:"tests"`
+
+	// source, line and column are the position of the filter in the config files.
+	source       string
+	line, column int
+}
+
+func (f *configFilter) UnmarshalYAML(node *yaml.Node) error {
+	type plain configFilter
+	err := node.Decode((*plain)(f))
+	if err != nil {
+		return err
+	}
+	f.line, f.column = node.Line, node.Column
+	return nil
+}
+
+// position returns the position of the filter in the config files, e.g.
+// "gmail-blade.yml:12:5".
+func (f *configFilter) position() string {
+	return fmt.Sprintf("%s:%d:%d", f.source, f.line, f.column)
 }
 
 func parseConfig(path string) (*config, error) {
+	return loadConfig(path, secretResolver{})
+}
+
+// loadConfig parses and validates the config file, with secrets resolved by
+// the resolver.
+func loadConfig(path string, secrets secretResolver) (*config, error) {
+	// Secrets are resolved again on every load, e.g. to pick up rotated ones.
+	secrets.resolved = make(map[string]string)
+
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, errors.Wrap(err, "read config file")
 	}
 
 	var c config
-	if err := yaml.Unmarshal(data, &c); err != nil {
-		return nil, errors.Wrap(err, "parse config file")
+	err = decodeConfigFile(path, data, &c)
+	if err != nil {
+		return nil, err
 	}
-
-	c.Credentials.Password = os.ExpandEnv(c.Credentials.Password)
-	if c.Credentials.Password == "" {
-		fmt.Print("Password: ")
-		password, err := term.ReadPassword(syscall.Stdin)
-		if err != nil {
-			return nil, errors.Wrap(err, "read password")
+	c.dir = filepath.Dir(path)
+	for i := range c.Filters {
+		c.Filters[i].source = path
+	}
+	for i := range c.Accounts {
+		for j := range c.Accounts[i].Filters {
+			c.Accounts[i].Filters[j].source = path
 		}
-		fmt.Println()
-		c.Credentials.Password = string(password)
+	}
+	for name, d := range c.Definitions {
+		d.source = path
+		c.Definitions[name] = d
+	}
+
+	err = includeConfigFiles(&c, path)
+	if err != nil {
+		return nil, err
 	}
 
 	if c.Server.SleepInterval == "" {
@@ -99,28 +294,109 @@ func parseConfig(path string) (*config, error) {
 		return nil, errors.Wrapf(err, "invalid server sleep interval %q", c.Server.SleepInterval)
 	}
 
-	c.Cache.CloudflareKV.APIToken = os.ExpandEnv(c.Cache.CloudflareKV.APIToken)
-	if c.Cache.CloudflareKV.enabled() {
-		if c.Cache.CloudflareKV.AccountID == "" {
-			return nil, errors.New("cache.cloudflare_kv.account_id cannot be empty")
+	if len(c.Mailboxes) == 0 {
+		c.Mailboxes = []string{"INBOX"}
+	}
+
+	err = compileDefinitions(c.Definitions)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.Accounts) == 0 {
+		c.Accounts = []configAccount{
+			{
+				Credentials: c.Credentials,
+				Cache:       c.Cache,
+			},
+		}
+		// Keep using the key from before multiple accounts were supported.
+		if c.Accounts[0].Cache.CloudflareKV.Key == "" {
+			c.Accounts[0].Cache.CloudflareKV.Key = cloudflareKVHighestUIDKey
+		}
+	} else if c.Credentials.Username != "" {
+		return nil, errors.New("credentials cannot be used together with accounts")
+	}
+
+	type cacheLocation struct {
+		accountID, namespaceID, key string
+	}
+	cacheLocations := make(map[cacheLocation]string)
+	for i := range c.Accounts {
+		account := &c.Accounts[i]
+		if account.Credentials.Username == "" {
+			return nil, errors.Errorf("credentials.username of account #%d cannot be empty", i+1)
+		}
+		if account.Name == "" {
+			account.Name = account.Credentials.Username
+		}
+
+		err = parseCredentials(&account.Credentials, account.Name, c.dir, secrets)
+		if err != nil {
+			return nil, errors.Wrapf(err, "account %q", account.Name)
+		}
+
+		if account.IMAP == (configIMAP{}) {
+			account.IMAP = c.Server.IMAP
+		}
+		err = account.IMAP.setDefaults()
+		if err != nil {
+			return nil, errors.Wrapf(err, "account %q", account.Name)
+		}
+
+		if !account.Cache.CloudflareKV.enabled() {
+			key := account.Cache.CloudflareKV.Key
+			account.Cache = c.Cache
+			if key != "" {
+				account.Cache.CloudflareKV.Key = key
+			}
+		}
+		if account.Cache.CloudflareKV.Key == "" {
+			account.Cache.CloudflareKV.Key = cloudflareKVHighestUIDKey + ":" + account.Credentials.Username
 		}
-		if c.Cache.CloudflareKV.NamespaceID == "" {
-			return nil, errors.New("cache.cloudflare_kv.namespace_id cannot be empty")
+		err = account.Cache.CloudflareKV.validate(secrets)
+		if err != nil {
+			return nil, errors.Wrapf(err, "account %q", account.Name)
+		}
+		if account.Cache.CloudflareKV.enabled() {
+			location := cacheLocation{
+				accountID:   account.Cache.CloudflareKV.AccountID,
+				namespaceID: account.Cache.CloudflareKV.NamespaceID,
+				key:         account.Cache.CloudflareKV.Key,
+			}
+			if other, ok := cacheLocations[location]; ok {
+				return nil, errors.Errorf("accounts %q and %q cannot use the same cache.cloudflare_kv.key %q", other, account.Name, location.key)
+			}
+			cacheLocations[location] = account.Name
+		}
+
+		if len(account.Mailboxes) == 0 {
+			account.Mailboxes = c.Mailboxes
 		}
-		if c.Cache.CloudflareKV.APIToken == "" {
-			return nil, errors.New("cache.cloudflare_kv.api_token cannot be empty")
+		if account.Search == "" {
+			account.Search = c.Search
 		}
 	}
 
-	c.GitHub.PersonalAccessToken = os.ExpandEnv(c.GitHub.PersonalAccessToken)
-	c.Slack.WebhookURL = os.ExpandEnv(c.Slack.WebhookURL)
+	c.GitHub.PersonalAccessToken, err = secrets.resolve(c.GitHub.PersonalAccessToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve github.personal_access_token")
+	}
+	c.Slack.WebhookURL, err = secrets.resolve(c.Slack.WebhookURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve slack.webhook_url")
+	}
 
 	var requireGitHubPAT bool
 	if c.GitHub.Approval.Enabled {
 		requireGitHubPAT = true
 	} else {
+		filters := slices.Clone(c.Filters)
+		for _, account := range c.Accounts {
+			filters = append(filters, account.Filters...)
+		}
 	loop:
-		for _, f := range c.Filters {
+		for _, f := range filters {
 			for _, prefetch := range f.Prefetches {
 				if githubPullRequestRegexp.MatchString(prefetch) {
 					requireGitHubPAT = true
@@ -130,17 +406,22 @@ func parseConfig(path string) (*config, error) {
 		}
 	}
 
-	if requireGitHubPAT && c.GitHub.PersonalAccessToken == "" {
-		fmt.Print("GitHub Personal Access Token: ")
-		token, err := term.ReadPassword(syscall.Stdin)
+	if requireGitHubPAT {
+		err = secrets.prompt(&c.GitHub.PersonalAccessToken, "GitHub Personal Access Token: ")
 		if err != nil {
 			return nil, errors.Wrap(err, "read GitHub personal access token")
 		}
-		fmt.Println()
-		c.GitHub.PersonalAccessToken = string(token)
 	}
 
 	if c.GitHub.Approval.Enabled {
+		c.GitHub.Approval.AllowedUsernames, err = expandListDefinitions(c.Definitions, c.GitHub.Approval.AllowedUsernames)
+		if err != nil {
+			return nil, errors.Wrap(err, "github.approval.allowed_usernames")
+		}
+		c.GitHub.Approval.AllowedRepositories, err = expandListDefinitions(c.Definitions, c.GitHub.Approval.AllowedRepositories)
+		if err != nil {
+			return nil, errors.Wrap(err, "github.approval.allowed_repositories")
+		}
 		if len(c.GitHub.Approval.AllowedUsernames) == 0 {
 			return nil, errors.New("github.approval.allowed_usernames cannot be empty")
 		}
@@ -149,46 +430,250 @@ func parseConfig(path string) (*config, error) {
 		}
 	}
 
-	if c.Slack.SendLogLevel != "" && c.Slack.WebhookURL == "" {
-		fmt.Print("Slack Webhook URL: ")
-		webhookURL, err := term.ReadPassword(syscall.Stdin)
+	if c.Slack.SendLogLevel != "" {
+		err = secrets.prompt(&c.Slack.WebhookURL, "Slack Webhook URL: ")
 		if err != nil {
 			return nil, errors.Wrap(err, "read Slack webhook URL")
 		}
-		fmt.Println()
-		c.Slack.WebhookURL = string(webhookURL)
 	}
 
-	for i, f := range c.Filters {
-		program, err := expr.Compile(f.Condition)
+	err = c.Storage.S3.validate(secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	err = compileFilters(&c, c.Filters)
+	if err != nil {
+		return nil, err
+	}
+	for i := range c.Accounts {
+		account := &c.Accounts[i]
+		if len(account.Filters) == 0 {
+			account.Filters = c.Filters
+		} else {
+			err = compileFilters(&c, account.Filters)
+			if err != nil {
+				return nil, errors.Wrapf(err, "account %q", account.Name)
+			}
+		}
+
+		for _, f := range account.Filters {
+			for _, mailbox := range f.Mailboxes {
+				if !slices.Contains(account.Mailboxes, mailbox) {
+					return nil, errors.Errorf("%s: mailbox %q of filter %q is not in the configured mailboxes of account %q", f.position(), mailbox, f.Name, account.Name)
+				}
+			}
+		}
+	}
+
+	return &c, nil
+}
+
+// parseCredentials resolves the secrets in the credentials, sets up OAuth2 when
+// configured and prompts for the password when it is empty. The OAuth2 token
+// file is resolved relative to the directory of the config file.
+func parseCredentials(credentials *configCredentials, accountName, configDir string, secrets secretResolver) error {
+	var err error
+	credentials.Password, err = secrets.resolve(credentials.Password)
+	if err != nil {
+		return errors.Wrap(err, "resolve credentials.password")
+	}
+	if credentials.OAuth2.enabled() {
+		credentials.OAuth2.ClientSecret, err = secrets.resolve(credentials.OAuth2.ClientSecret)
+		if err != nil {
+			return errors.Wrap(err, "resolve credentials.oauth2.client_secret")
+		}
+		credentials.OAuth2.RefreshToken, err = secrets.resolve(credentials.OAuth2.RefreshToken)
+		if err != nil {
+			return errors.Wrap(err, "resolve credentials.oauth2.refresh_token")
+		}
+		if credentials.OAuth2.ClientID == "" {
+			return errors.New("credentials.oauth2.client_id cannot be empty")
+		}
+		if credentials.OAuth2.RefreshToken == "" && credentials.OAuth2.TokenFile == "" {
+			return errors.New("credentials.oauth2.refresh_token and credentials.oauth2.token_file cannot both be empty")
+		}
+		if credentials.OAuth2.TokenFile != "" && !filepath.IsAbs(credentials.OAuth2.TokenFile) {
+			credentials.OAuth2.TokenFile = filepath.Join(configDir, credentials.OAuth2.TokenFile)
+		}
+		if secrets.disabled {
+			return nil
+		}
+		credentials.OAuth2.tokenSource, err = newOAuth2TokenSource(credentials.OAuth2)
+		if err != nil {
+			return errors.Wrap(err, "create OAuth2 token source")
+		}
+	} else {
+		prompt := fmt.Sprintf("Password for %s: ", credentials.Username)
+		if accountName != credentials.Username {
+			prompt = fmt.Sprintf("Password for %s (%s): ", accountName, credentials.Username)
+		}
+		err = secrets.prompt(&credentials.Password, prompt)
 		if err != nil {
-			return nil, errors.Wrapf(err, "compile condition for filter %q", f.Name)
+			return errors.Wrap(err, "read password")
+		}
+	}
+	return nil
+}
+
+// setDefaults fills in the defaults of the IMAP server, which is Gmail.
+func (c *configIMAP) setDefaults() error {
+	if c.Host == "" {
+		c.Host = "imap.gmail.com"
+	}
+	switch c.Security {
+	case "":
+		c.Security = imapSecurityTLS
+	case imapSecurityTLS, imapSecurityStartTLS, imapSecurityPlain:
+	default:
+		return errors.Errorf("invalid imap.security %q, must be one of %q, %q or %q", c.Security, imapSecurityTLS, imapSecurityStartTLS, imapSecurityPlain)
+	}
+	if c.Port == 0 {
+		if c.Security == imapSecurityTLS {
+			c.Port = 993
+		} else {
+			c.Port = 143
+		}
+	}
+	if c.TrashMailbox == "" {
+		c.TrashMailbox = "[Gmail]/Trash"
+	}
+	if c.ArchiveMailbox == "" {
+		c.ArchiveMailbox = "[Gmail]/All Mail"
+	}
+	return nil
+}
+
+// validate resolves the API token and checks that all required fields are set
+// when the cache is enabled.
+func (c *configCloudflareKV) validate(secrets secretResolver) error {
+	var err error
+	c.APIToken, err = secrets.resolve(c.APIToken)
+	if err != nil {
+		return errors.Wrap(err, "resolve cache.cloudflare_kv.api_token")
+	}
+	if !c.enabled() {
+		return nil
+	}
+	if c.AccountID == "" {
+		return errors.New("cache.cloudflare_kv.account_id cannot be empty")
+	}
+	if c.NamespaceID == "" {
+		return errors.New("cache.cloudflare_kv.namespace_id cannot be empty")
+	}
+	if c.APIToken == "" {
+		return errors.New("cache.cloudflare_kv.api_token cannot be empty")
+	}
+	return nil
+}
+
+// conditionEnv is the environment of condition expressions, which conditions
+// are type-checked against when loading the config.
+type conditionEnv struct {
+	Message messageEnv `expr:"message"`
+	// GitHubPullRequest is only set when prefetched with "GitHub pull request".
+	GitHubPullRequest *githubPullRequest `expr:"githubPullRequest"`
+}
+
+// conditionOptions returns the options to compile expressions of conditions
+// with references to the definitions.
+func conditionOptions(definitions map[string]configDefinition) []expr.Option {
+	// References to definitions must be replaced before other patches apply to
+	// the definitions.
+	references := &definitionReferences{definitions: definitions}
+	options := []expr.Option{
+		expr.Env(conditionEnv{}),
+		expr.Patch(references),
+		expr.Patch(definitionPatcher{references: references}),
+	}
+	return append(options, conditionFunctions...)
+}
+
+// compileCondition compiles the condition expression of a filter, or a part of
+// it, which must be a boolean.
+func compileCondition(condition string, definitions map[string]configDefinition) (*vm.Program, error) {
+	program, err := expr.Compile(condition, append(conditionOptions(definitions), expr.AsBool())...)
+	if err != nil {
+		return nil, err
+	}
+	return program, checkConstantArguments(program)
+}
+
+// findIdentifier returns the first reference to the variable of the name in the
+// compiled condition, including references within definitions, or nil if there
+// is none.
+func findIdentifier(program *vm.Program, name string) *ast.IdentifierNode {
+	var found *ast.IdentifierNode
+	node := program.Node()
+	ast.Walk(&node, visitorFunc(func(node *ast.Node) {
+		if ident, ok := (*node).(*ast.IdentifierNode); ok && ident.Value == name && found == nil {
+			found = ident
+		}
+	}))
+	return found
+}
+
+// compileFilters compiles the conditions of the filters in place and validates
+// their actions and prefetches.
+func compileFilters(c *config, filters []configFilter) error {
+	err := checkDuplicateFilters(filters)
+	if err != nil {
+		return err
+	}
+
+	for i, f := range filters {
+		program, err := compileCondition(f.Condition, c.Definitions)
+		if err != nil {
+			return errors.Wrapf(err, "%s: compile condition for filter %q", f.position(), f.Name)
+		}
+		filters[i].CompiledCondition = program
+
+		hasGitHubPullRequestPrefetch := false
+		for j, prefetch := range f.Prefetches {
+			if !githubPullRequestRegexp.MatchString(prefetch) {
+				return errors.Errorf("%s: unknown prefetches[%d] %q of filter %q", f.position(), j, prefetch, f.Name)
+			}
+			hasGitHubPullRequestPrefetch = true
+		}
+		// Without the prefetch, githubPullRequest is always nil and the
+		// condition silently never matches on it.
+		if ident := findIdentifier(program, prefetchGitHubPullRequestKey); ident != nil && !hasGitHubPullRequestPrefetch {
+			err = (&file.Error{
+				Location: ident.Location(),
+				Message:  `githubPullRequest requires "GitHub pull request" prefetch`,
+			}).Bind(program.Source())
+			return errors.Wrapf(err, "%s: compile condition for filter %q", f.position(), f.Name)
 		}
-		c.Filters[i].CompiledCondition = program
 
 		var hasGitHubReviewAction bool
-		for _, action := range f.Actions {
-			if githubReviewRegexp.MatchString(action) {
+		for j := range f.Actions {
+			action := &f.Actions[j]
+			action.dir = filepath.Dir(f.source)
+			err = action.parse()
+			if err != nil {
+				return errors.Wrapf(err, "%s: actions[%d] of filter %q", f.position(), j, f.Name)
+			}
+			if action.Type == actionSaveAttachmentsTo && strings.HasPrefix(action.Path, s3PathPrefix) && !c.Storage.S3.enabled() && !c.fragment {
+				return errors.Errorf("%s: actions[%d] of filter %q saves to S3 but storage.s3 is not configured", f.position(), j, f.Name)
+			}
+			if action.Type == actionGitHubReview {
 				hasGitHubReviewAction = true
-				if !c.GitHub.Approval.Enabled {
-					return nil, errors.Errorf("GitHub review action is used in filter %q but GitHub integration is not enabled", f.Name)
+				if !c.GitHub.Approval.Enabled && !c.fragment {
+					return errors.Errorf("%s: GitHub review action is used in filter %q but GitHub integration is not enabled", f.position(), f.Name)
 				}
 			}
 		}
 
-		if hasGitHubReviewAction {
-			hasGitHubPullRequestPrefetch := false
-			for _, prefetch := range f.Prefetches {
-				if githubPullRequestRegexp.MatchString(prefetch) {
-					hasGitHubPullRequestPrefetch = true
-					break
-				}
-			}
-			if !hasGitHubPullRequestPrefetch {
-				return nil, errors.Errorf(`"GitHub review" action in filter %q requires "GitHub pull request" prefetch`, f.Name)
+		for j := range f.Tests {
+			err = f.Tests[j].validate(c.dir)
+			if err != nil {
+				return errors.Wrapf(err, "%s: tests[%d] of filter %q", f.position(), j, f.Name)
 			}
 		}
-	}
 
-	return &c, nil
+		if hasGitHubReviewAction && !hasGitHubPullRequestPrefetch {
+			return errors.Errorf(`%s: "GitHub review" action in filter %q requires "GitHub pull request" prefetch`, f.position(), f.Name)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompileFiltersGitHubPullRequest(t *testing.T) {
+	definitions := map[string]configDefinition{
+		"dependabot": {Expression: `githubPullRequest != nil and githubPullRequest.author == "dependabot[bot]"`},
+	}
+	if err := compileDefinitions(definitions); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		filter  configFilter
+		wantErr string
+	}{
+		{
+			name: "with prefetch",
+			filter: configFilter{
+				Condition:  `githubPullRequest != nil`,
+				Prefetches: []string{"GitHub pull request"},
+			},
+		},
+		{
+			name: "without prefetch",
+			filter: configFilter{
+				Condition: `message.subject contains "PR" and githubPullRequest != nil`,
+			},
+			wantErr: `githubPullRequest requires "GitHub pull request" prefetch`,
+		},
+		{
+			name: "within definition without prefetch",
+			filter: configFilter{
+				Condition: `dependabot`,
+			},
+			wantErr: `githubPullRequest requires "GitHub pull request" prefetch`,
+		},
+		{
+			name: "field of the same name",
+			filter: configFilter{
+				Condition: `"githubPullRequest" in message.headers`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.filter.Name = "Dependabot"
+			c := &config{Definitions: definitions}
+			err := compileFilters(c, []configFilter{test.filter})
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) || !strings.Contains(err.Error(), `filter "Dependabot"`) {
+				t.Fatalf("got error %v, want %q for the filter", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRelativePaths(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gmail-blade.yml")
+	err := os.WriteFile(path, []byte(`
+credentials:
+  username: "jane@acme.com"
+  oauth2:
+    client_id: "client"
+    token_file: "gmail-blade-token.json"
+filters:
+  - name: "Save invoices"
+    condition: 'true'
+    actions: ['save attachments to "invoices/{{.Filename}}"']
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The working directory is not the directory of the config file.
+	config, err := loadConfig(path, secretResolver{disabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := config.Accounts[0]
+	if got, want := account.Credentials.OAuth2.TokenFile, filepath.Join(dir, "gmail-blade-token.json"); got != want {
+		t.Fatalf("got token file %q, want %q", got, want)
+	}
+	action := account.Filters[0].Actions[0]
+	got, err := renderAttachmentPath(action.pathTemplate, action.dir, attachmentPathData{Filename: "invoice.pdf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "invoices", "invoice.pdf"); got != want {
+		t.Fatalf("got attachment path %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/parser"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// configDefinition is a named definition that conditions reference by its name,
+// which is either a sub-expression, e.g. `'"notifications@github.com" in
+// message.from'`, or a constant list, e.g. `["unknwon", "joe"]`.
+type configDefinition struct {
+	Expression string `yaml:"-"`
+	// List is the constant list, which is []string when all items are strings,
+	// or []any otherwise. It is nil for sub-expressions.
+	List any `yaml:"-"`
+
+	// source, line and column are the position of the definition in the config
+	// files.
+	source       string
+	line, column int
+	// tree is the syntax tree of the definition, which is parsed once by
+	// compileDefinitions and cloned for every reference.
+	tree ast.Node
+}
+
+func (d *configDefinition) UnmarshalYAML(node *yaml.Node) error {
+	d.line, d.column = node.Line, node.Column
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Decode(&d.Expression)
+	case yaml.SequenceNode:
+		var items []any
+		err := node.Decode(&items)
+		if err != nil {
+			return err
+		}
+		strs := make([]string, 0, len(items))
+		for _, item := range items {
+			if s, ok := item.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		if len(strs) == len(items) {
+			d.List = strs
+		} else {
+			d.List = items
+		}
+		return nil
+	}
+	return errors.Errorf("line %d: definition must be an expression or a list", node.Line)
+}
+
+// position returns the position of the definition in the config files, e.g.
+// "gmail-blade.yml:12:5".
+func (d configDefinition) position() string {
+	return fmt.Sprintf("%s:%d:%d", d.source, d.line, d.column)
+}
+
+// parse parses the definition into its syntax tree.
+func (d *configDefinition) parse() error {
+	if d.List != nil {
+		d.tree = &ast.ConstantNode{Value: d.List}
+		return nil
+	}
+	tree, err := parser.Parse(d.Expression)
+	if err != nil {
+		return err
+	}
+	d.tree = tree.Node
+	return nil
+}
+
+// cloneNode returns a deep copy of the syntax tree, as the tree of a condition
+// is modified in place when it is compiled.
+func cloneNode(node ast.Node) ast.Node {
+	if node == nil {
+		return nil
+	}
+	v := reflect.New(reflect.TypeOf(node).Elem())
+	v.Elem().Set(reflect.ValueOf(node).Elem())
+	nodeType := reflect.TypeFor[ast.Node]()
+	for i := range v.Elem().NumField() {
+		field := v.Elem().Field(i)
+		switch {
+		case !field.CanSet():
+		case field.Type() == nodeType && !field.IsNil():
+			field.Set(reflect.ValueOf(cloneNode(field.Interface().(ast.Node))))
+		case field.Type() == reflect.SliceOf(nodeType) && !field.IsNil():
+			nodes := make([]ast.Node, field.Len())
+			for j := range nodes {
+				nodes[j] = cloneNode(field.Index(j).Interface().(ast.Node))
+			}
+			field.Set(reflect.ValueOf(nodes))
+		}
+	}
+	return v.Interface().(ast.Node)
+}
+
+// definitionReferences collects the identifiers that reference the
+// definitions, by the nodes holding them. Identifiers of variables that shadow
+// definitions are not references, e.g. "github" in `let github = 1; github`.
+type definitionReferences struct {
+	definitions map[string]configDefinition
+	nodes       map[*ast.Node]*ast.IdentifierNode
+}
+
+func (r *definitionReferences) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.IdentifierNode:
+		if _, ok := r.definitions[n.Value]; !ok {
+			return
+		}
+		if r.nodes == nil {
+			r.nodes = make(map[*ast.Node]*ast.IdentifierNode)
+		}
+		r.nodes[node] = n
+	case *ast.VariableDeclaratorNode:
+		// Nodes are visited after their children, and the variable is only in
+		// scope of the expression, not of its value.
+		ast.Walk(&n.Expr, visitorFunc(func(node *ast.Node) {
+			if ident, ok := r.nodes[node]; ok && ident.Value == n.Name {
+				delete(r.nodes, node)
+			}
+		}))
+	}
+}
+
+// definitionPatcher replaces references to the definitions in conditions with
+// the definitions, including references within the definitions. The references
+// must have been collected from the whole condition beforehand, as whether an
+// identifier is shadowed is only known once its parents are visited.
+type definitionPatcher struct {
+	references *definitionReferences
+}
+
+func (p definitionPatcher) Visit(node *ast.Node) {
+	ident, ok := p.references.nodes[node]
+	if !ok {
+		return
+	}
+	// Definitions are parsed when loading the config, see compileDefinitions.
+	d := p.references.definitions[ident.Value]
+	if d.tree == nil {
+		return
+	}
+	tree := cloneNode(d.tree)
+	references := &definitionReferences{definitions: p.references.definitions}
+	ast.Walk(&tree, references)
+	ast.Walk(&tree, definitionPatcher{references: references})
+	// Errors within the definition are reported at the reference.
+	ast.Walk(&tree, visitorFunc(func(node *ast.Node) {
+		(*node).SetLocation(ident.Location())
+	}))
+	*node = tree
+}
+
+// compileDefinitions validates the names of the definitions and compiles each
+// sub-expression once, so that errors are reported against the definition
+// instead of every condition referencing it.
+func compileDefinitions(definitions map[string]configDefinition) error {
+	names := slices.Sorted(maps.Keys(definitions))
+	refs := make(map[string][]string, len(definitions))
+	for _, name := range names {
+		tree, err := parser.Parse(name)
+		if err != nil {
+			return errors.Errorf("%s: invalid definition name %q", definitions[name].position(), name)
+		}
+		d := definitions[name]
+		if ident, ok := tree.Node.(*ast.IdentifierNode); !ok || ident.Value != name {
+			return errors.Errorf("%s: invalid definition name %q", d.position(), name)
+		}
+		if _, err = expr.Compile(name, conditionOptions(nil)...); err == nil {
+			return errors.Errorf("%s: definition %q conflicts with the variable or function of the same name", d.position(), name)
+		}
+
+		err = d.parse()
+		if err != nil {
+			return errors.Wrapf(err, "%s: parse definition %q", d.position(), name)
+		}
+		definitions[name] = d
+		if d.List != nil {
+			continue
+		}
+		references := &definitionReferences{definitions: definitions}
+		ast.Walk(&d.tree, references)
+		for _, ident := range references.nodes {
+			refs[name] = append(refs[name], ident.Value)
+		}
+		// Sorted to report the same cycle on every load.
+		slices.Sort(refs[name])
+	}
+
+	// Definitions referencing themselves would be expanded forever.
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	states := make(map[string]int, len(definitions))
+	var visit func(path []string) error
+	visit = func(path []string) error {
+		name := path[len(path)-1]
+		switch states[name] {
+		case visiting:
+			return errors.Errorf("%s: definition %q references itself: %s", definitions[name].position(), name, strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+		states[name] = visiting
+		for _, ref := range refs[name] {
+			err := visit(append(path, ref))
+			if err != nil {
+				return err
+			}
+		}
+		states[name] = visited
+		return nil
+	}
+	for _, name := range names {
+		err := visit([]string{name})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		d := definitions[name]
+		if d.List != nil {
+			continue
+		}
+		program, err := expr.Compile(d.Expression, conditionOptions(definitions)...)
+		if err == nil {
+			err = checkConstantArguments(program)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "%s: compile definition %q", d.position(), name)
+		}
+	}
+	return nil
+}
+
+// listDefinitionPrefix is the prefix of items that are names of list
+// definitions, e.g. "@teammates", which cannot be GitHub usernames or
+// repository names.
+const listDefinitionPrefix = "@"
+
+// expandListDefinitions replaces the items that are names of list definitions
+// with the prefix with the items of the lists, e.g. to share allowlists with
+// conditions. Other items are kept as is, even when they are the same as names
+// of definitions.
+func expandListDefinitions(definitions map[string]configDefinition, items []string) ([]string, error) {
+	var expanded []string
+	for _, item := range items {
+		name, ok := strings.CutPrefix(item, listDefinitionPrefix)
+		if !ok {
+			expanded = append(expanded, item)
+			continue
+		}
+		d, ok := definitions[name]
+		if !ok {
+			return nil, errors.Errorf("definition %q does not exist", name)
+		}
+		list, ok := d.List.([]string)
+		if !ok {
+			return nil, errors.Errorf("definition %q must be a list of strings", name)
+		}
+		expanded = append(expanded, list...)
+	}
+	return expanded, nil
+}
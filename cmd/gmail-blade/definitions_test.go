@@ -0,0 +1,157 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/expr-lang/expr"
+)
+
+func TestDefinitionPatcher(t *testing.T) {
+	definitions := map[string]configDefinition{
+		"github":    {Expression: `anyFrom("*@github.com")`},
+		"teammates": {List: []string{"joe@acme.com", "jane@acme.com"}},
+		"githubTwice": {
+			Expression: `github and github`,
+		},
+		// The variable is local to the definition.
+		"shadowed": {Expression: `let github = "no"; github == "no"`},
+	}
+	if err := compileDefinitions(definitions); err != nil {
+		t.Fatal(err)
+	}
+
+	env := conditionEnv{Message: messageEnv{From: []string{"notifications@github.com"}}}
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{condition: `github`, want: true},
+		{condition: `githubTwice and github`, want: true},
+		{condition: `"joe@acme.com" in teammates`, want: true},
+		{condition: `let github = false; github`, want: false},
+		{condition: `let github = github; github`, want: true},
+		{condition: `let github = 1; github > 0 and githubTwice`, want: true},
+		{condition: `(let github = false; github) or github`, want: true},
+		{condition: `shadowed and github`, want: true},
+		{condition: `all(["a"], let teammates = [#]; "a" in teammates)`, want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.condition, func(t *testing.T) {
+			program, err := compileCondition(test.condition, definitions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := expr.Run(program, env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompileDefinitions(t *testing.T) {
+	tests := []struct {
+		name        string
+		definitions map[string]configDefinition
+		wantErr     string
+	}{
+		{
+			name: "self reference",
+			definitions: map[string]configDefinition{
+				"a": {Expression: `b`},
+				"b": {Expression: `a`},
+			},
+			wantErr: `definition "a" references itself: a -> b -> a`,
+		},
+		{
+			name: "shadowed self reference",
+			definitions: map[string]configDefinition{
+				"a": {Expression: `let a = 1; a > 0`},
+			},
+		},
+		{
+			name: "conflict with variable",
+			definitions: map[string]configDefinition{
+				"message": {Expression: `true`},
+			},
+			wantErr: `definition "message" conflicts with the variable or function of the same name`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := compileDefinitions(test.definitions)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestExpandListDefinitions(t *testing.T) {
+	definitions := map[string]configDefinition{
+		"teammates": {List: []string{"joe", "jane"}},
+		"numbers":   {List: []any{1, 2}},
+		"github":    {Expression: `true`},
+	}
+	tests := []struct {
+		name    string
+		items   []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "expanded with prefix",
+			items: []string{"unknwon", "@teammates"},
+			want:  []string{"unknwon", "joe", "jane"},
+		},
+		{
+			// A username that is the same as the name of a definition.
+			name:  "kept without prefix",
+			items: []string{"teammates"},
+			want:  []string{"teammates"},
+		},
+		{
+			name:    "unknown definition",
+			items:   []string{"@team"},
+			wantErr: `definition "team" does not exist`,
+		},
+		{
+			name:    "not a list of strings",
+			items:   []string{"@numbers"},
+			wantErr: `definition "numbers" must be a list of strings`,
+		},
+		{
+			name:    "not a list",
+			items:   []string{"@github"},
+			wantErr: `definition "github" must be a list of strings`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := expandListDefinitions(definitions, test.items)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/parser"
+	"github.com/pkg/errors"
+)
+
+// conditionTerm is an operand of a logical operator in a condition, evaluated
+// on its own.
+type conditionTerm struct {
+	depth  int
+	source string
+	output any
+	err    error
+}
+
+// traceConditionTerms evaluates the operands of the logical operators in the
+// condition separately, e.g. "a", "b or c", "b" and "c" of `a and (b or c)`.
+// Operands are evaluated even when the operator would short-circuit.
+func traceConditionTerms(condition string, definitions map[string]configDefinition, env conditionEnv) ([]conditionTerm, error) {
+	tree, err := parser.Parse(condition)
+	if err != nil {
+		return nil, err
+	}
+
+	var terms []conditionTerm
+	var walk func(node ast.Node, depth int)
+	walk = func(node ast.Node, depth int) {
+		for _, operand := range logicalOperands(node) {
+			term := conditionTerm{
+				depth:  depth,
+				source: operand.String(),
+			}
+			program, err := compileCondition(term.source, definitions)
+			if err != nil {
+				term.err = err
+			} else {
+				term.output, term.err = expr.Run(program, env)
+			}
+			terms = append(terms, term)
+			walk(operand, depth+1)
+		}
+	}
+	walk(tree.Node, 0)
+	return terms, nil
+}
+
+// logicalOperands returns the operands of the node if it is a logical operator,
+// with chains of the same operator flattened, e.g. "a", "b" and "c" of
+// `a and b and c`.
+func logicalOperands(node ast.Node) []ast.Node {
+	normalize := func(operator string) string {
+		switch operator {
+		case "&&":
+			return "and"
+		case "||":
+			return "or"
+		}
+		return operator
+	}
+
+	switch n := node.(type) {
+	case *ast.BinaryNode:
+		operator := normalize(n.Operator)
+		if operator != "and" && operator != "or" {
+			return nil
+		}
+		var operands []ast.Node
+		for _, side := range []ast.Node{n.Left, n.Right} {
+			if b, ok := side.(*ast.BinaryNode); ok && normalize(b.Operator) == operator {
+				operands = append(operands, logicalOperands(b)...)
+			} else {
+				operands = append(operands, side)
+			}
+		}
+		return operands
+	case *ast.UnaryNode:
+		if n.Operator == "not" || n.Operator == "!" {
+			return []ast.Node{n.Node}
+		}
+	}
+	return nil
+}
+
+// writeExplanation writes the evaluation trace of every filter against the
+// message and the final list of actions to w.
+func writeExplanation(w io.Writer, config *config, source string, msg *message, mailbox string, result *evaluation) {
+	_, _ = fmt.Fprintf(w, "%s: %q\n", source, msg.Subject)
+	_, _ = fmt.Fprintf(w, "  From: %s\n", strings.Join(msg.From, ", "))
+	_, _ = fmt.Fprintf(w, "  Mailbox: %s\n", mailbox)
+	if slices.Contains(msg.Flags, string(imap.FlagSeen)) {
+		_, _ = fmt.Fprintln(w, "  Note: the message is read, which is skipped unless search is configured")
+	}
+
+	for i, trace := range result.traces {
+		f := trace.filter
+		_, _ = fmt.Fprintf(w, "\n  [%d] %q\n", i+1, f.Name)
+		if trace.skipped != "" {
+			_, _ = fmt.Fprintf(w, "      Skipped: %s\n", trace.skipped)
+			continue
+		}
+
+		for _, prefetch := range trace.prefetches {
+			_, _ = fmt.Fprintf(w, "      Prefetch: %s\n", prefetch)
+		}
+		_, _ = fmt.Fprintf(w, "      Condition: %s\n", strings.TrimSpace(f.Condition))
+		if trace.err != nil {
+			_, _ = fmt.Fprintf(w, "      Result: error: %v\n", trace.err)
+		} else {
+			_, _ = fmt.Fprintf(w, "      Result: %v\n", trace.output)
+		}
+
+		terms, err := traceConditionTerms(f.Condition, config.Definitions, trace.env)
+		if err != nil {
+			_, _ = fmt.Fprintf(w, "      Failed to trace condition: %v\n", err)
+		}
+		for _, term := range terms {
+			indent := strings.Repeat("  ", term.depth)
+			if term.err != nil {
+				_, _ = fmt.Fprintf(w, "        %serror  %s: %v\n", indent, term.source, term.err)
+			} else {
+				_, _ = fmt.Fprintf(w, "        %s%-5v  %s\n", indent, term.output, term.source)
+			}
+		}
+
+		if trace.matched {
+			actionNames := make([]string, len(f.Actions))
+			for j, action := range f.Actions {
+				actionNames[j] = action.String()
+			}
+			_, _ = fmt.Fprintf(w, "      Actions: %s\n", strings.Join(actionNames, ", "))
+			if f.HaltOnMatch {
+				_, _ = fmt.Fprintln(w, "      Halted evaluation of the following filters (halt-on-match)")
+			}
+		}
+	}
+
+	if len(result.actions) == 0 {
+		_, _ = fmt.Fprintln(w, "\n  No actions matched")
+		return
+	}
+	actionNames := make([]string, len(result.actions))
+	for i, action := range result.actions {
+		actionNames[i] = action.String()
+	}
+	_, _ = fmt.Fprintf(w, "\n  Actions: %s\n", strings.Join(actionNames, ", "))
+}
+
+// runExplain fetches the message with the UID from the mailbox, and writes the
+// evaluation trace of the filters to w without running any actions.
+func runExplain(logger Logger, ctx context.Context, w io.Writer, config *config, account *configAccount, mailbox string, uid imap.UID) error {
+	client, closeClient, err := getAuthenticatedClient(account.IMAP, account.Credentials, &imapclient.Options{})
+	if err != nil {
+		return errors.Wrap(err, "get authenticated IMAP client")
+	}
+	defer closeClient()
+
+	gmail := newGmailClientIfSupported(client, account)
+	defer func() { _ = gmail.Close() }()
+
+	_, err = client.Select(mailbox, &imap.SelectOptions{ReadOnly: true}).Wait()
+	if err != nil {
+		return errors.Wrap(err, "select mailbox")
+	}
+	messages, err := client.Fetch(imap.UIDSetNum(uid), messageFetchOptions()).Collect()
+	if err != nil {
+		return errors.Wrap(err, "fetch message")
+	}
+	if len(messages) == 0 {
+		return errors.Errorf("message with UID %d not found", uid)
+	}
+
+	var gmailAttrs map[imap.UID]gmailAttributes
+	if gmail != nil {
+		gmailAttrs, err = gmail.fetchAttributes(mailbox, []imap.UID{uid})
+		if err != nil {
+			return errors.Wrap(err, "fetch Gmail attributes")
+		}
+	}
+	msg, err := newMessage(messages[0], gmailAttrs[uid])
+	if err != nil {
+		return errors.Wrapf(err, "uid %d", uid)
+	}
+
+	for _, f := range account.Filters {
+		if f.Search == "" || msg.searchMatches[f.Search] {
+			continue
+		}
+		if gmail == nil {
+			return errors.Errorf("search of filter %q requires an IMAP server with the %s extension", f.Name, gmailCapability)
+		}
+		uids, err := gmail.search(mailbox, fmt.Sprintf("UID %d X-GM-RAW %s", uid, quoteIMAPString(f.Search)))
+		if err != nil {
+			return errors.Wrapf(err, "search message of filter %q", f.Name)
+		}
+		if slices.Contains(uids, uid) {
+			if msg.searchMatches == nil {
+				msg.searchMatches = make(map[string]bool)
+			}
+			msg.searchMatches[f.Search] = true
+		}
+	}
+
+	result := evaluate(logger, ctx, config, account, mailbox, msg, false)
+	writeExplanation(w, config, fmt.Sprintf("UID %d", uid), msg, mailbox, result)
+	return nil
+}
+
+// runExplainFile writes the evaluation trace of the filters against the
+// messages in the path to w, see readRawMessages for supported formats. Like
+// simulating, prefetches are skipped as it runs offline.
+func runExplainFile(logger Logger, ctx context.Context, w io.Writer, config *config, account *configAccount, mailbox string, path string) error {
+	messages, err := readRawMessages(path)
+	if err != nil {
+		return errors.Wrapf(err, "read %q", path)
+	}
+	for i, rawMsg := range messages {
+		msg, err := newMessageFromRaw(imap.UID(i+1), rawMsg.raw, rawMsg.flags)
+		if err != nil {
+			return errors.Wrapf(err, "parse %q", rawMsg.source)
+		}
+		if i > 0 {
+			_, _ = fmt.Fprintln(w)
+		}
+		writeExplanation(w, config, rawMsg.source, msg, mailbox, evaluate(logger, ctx, config, account, mailbox, msg, true))
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	gomessage "github.com/emersion/go-message"
+	"github.com/pkg/errors"
+)
+
+// configFilterTest is a test case of a filter, which evaluates all filters of
+// the account against the message and checks the outcome.
+type configFilterTest struct {
+	Name    string             `yaml:"name"`
+	File    string             `yaml:"file"`    // The path to an .eml file, relative to the config file
+	Message *configTestMessage `yaml:"message"` // The inline message, instead of File
+	Mailbox string             `yaml:"mailbox"` // The mailbox the message is in, defaults to the first configured mailbox
+
+	// Match is whether the filter is expected to match the message, which fails
+	// when an earlier filter halts on match.
+	Match *bool `yaml:"match"`
+	// Actions is the expected actions of all filters that match the message, in
+	// the order they would run.
+	Actions []configAction `yaml:"actions"`
+}
+
+// configTestMessage is an inline message of a filter test. Fields that are not
+// set are empty.
+type configTestMessage struct {
+	From        []string               `yaml:"from"`
+	FromName    []string               `yaml:"from_name"`
+	Subject     string                 `yaml:"subject"`
+	Cc          []string               `yaml:"cc"`
+	To          []string               `yaml:"to"`
+	ReplyTo     []string               `yaml:"reply_to"`
+	Body        string                 `yaml:"body"`      // The text body
+	HTMLBody    string                 `yaml:"html_body"` // The HTML body
+	Labels      []string               `yaml:"labels"`
+	ThreadID    string                 `yaml:"thread_id"`
+	Headers     map[string]string      `yaml:"headers"`
+	Date        time.Time              `yaml:"date"`
+	MessageID   string                 `yaml:"message_id"`
+	InReplyTo   []string               `yaml:"in_reply_to"`
+	Flags       []string               `yaml:"flags"`
+	Attachments []configTestAttachment `yaml:"attachments"`
+}
+
+type configTestAttachment struct {
+	Filename  string `yaml:"filename"`
+	MIMEType  string `yaml:"mime_type"`
+	Size      int    `yaml:"size"`
+	ContentID string `yaml:"content_id"`
+	Inline    bool   `yaml:"inline"`
+}
+
+// validate checks the test case, parses the expected actions, and resolves the
+// file path relative to the directory of the config file.
+func (t *configFilterTest) validate(configDir string) error {
+	if (t.File == "") == (t.Message == nil) {
+		return errors.New("exactly one of file and message must be set")
+	}
+	if t.Match == nil && t.Actions == nil {
+		return errors.New("at least one of match and actions must be set")
+	}
+	if t.File != "" && !filepath.IsAbs(t.File) {
+		t.File = filepath.Join(configDir, t.File)
+	}
+	for i := range t.Actions {
+		err := t.Actions[i].parse()
+		if err != nil {
+			return errors.Wrapf(err, "actions[%d]", i)
+		}
+	}
+	return nil
+}
+
+// message builds the message of the test case.
+func (t *configFilterTest) message() (*message, error) {
+	if t.File != "" {
+		raw, err := os.ReadFile(t.File)
+		if err != nil {
+			return nil, err
+		}
+		return newMessageFromRaw(1, raw, nil)
+	}
+
+	m := t.Message
+	entity, err := m.entity()
+	if err != nil {
+		return nil, errors.Wrap(err, "build message")
+	}
+	msg, err := buildMessage(entity)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse message")
+	}
+
+	// The headers are as written, without the ones of the structure built for
+	// the bodies and attachments, e.g. "Content-Type".
+	msg.Headers = make(map[string][]string, len(m.Headers))
+	for key, value := range m.Headers {
+		msg.Headers[textproto.CanonicalMIMEHeaderKey(key)] = []string{value}
+	}
+
+	// Use empty lists instead of nil, the same as messages from the IMAP server.
+	orEmpty := func(s []string) []string {
+		if s == nil {
+			return []string{}
+		}
+		return s
+	}
+	msg.UID = 1
+	msg.From = orEmpty(m.From)
+	msg.FromName = m.FromName
+	if msg.FromName == nil {
+		msg.FromName = make([]string, len(m.From))
+	}
+	msg.Subject = m.Subject
+	msg.Cc = orEmpty(m.Cc)
+	msg.To = orEmpty(m.To)
+	msg.ReplyTo = orEmpty(m.ReplyTo)
+	msg.Labels = orEmpty(m.Labels)
+	msg.ThreadID = m.ThreadID
+	msg.Date = m.Date
+	msg.Size = int64(len(m.Body) + len(m.HTMLBody))
+	msg.MessageID = m.MessageID
+	msg.InReplyTo = orEmpty(m.InReplyTo)
+	msg.Flags = orEmpty(m.Flags)
+	return msg, nil
+}
+
+// entity builds the MIME entity of the inline message with a part for each of
+// the bodies and attachments, so that it is parsed the same way as the messages
+// from the IMAP server. Attachments are filled with zeros up to their sizes.
+func (m *configTestMessage) entity() (*gomessage.Entity, error) {
+	var parts []*gomessage.Entity
+	addPart := func(h gomessage.Header, body io.Reader) error {
+		part, err := gomessage.New(h, body)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, part)
+		return nil
+	}
+
+	if m.Body != "" || m.HTMLBody == "" {
+		var h gomessage.Header
+		h.SetContentType("text/plain", nil)
+		if err := addPart(h, strings.NewReader(m.Body)); err != nil {
+			return nil, err
+		}
+	}
+	if m.HTMLBody != "" {
+		var h gomessage.Header
+		h.SetContentType("text/html", nil)
+		if err := addPart(h, strings.NewReader(m.HTMLBody)); err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range m.Attachments {
+		var h gomessage.Header
+		mimeType := a.MIMEType
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+		h.SetContentType(mimeType, nil)
+		disposition := "attachment"
+		if a.Inline {
+			disposition = "inline"
+		}
+		var params map[string]string
+		if a.Filename != "" {
+			params = map[string]string{"filename": a.Filename}
+		}
+		h.SetContentDisposition(disposition, params)
+		if a.ContentID != "" {
+			h.Set("Content-Id", "<"+a.ContentID+">")
+		}
+		if err := addPart(h, io.LimitReader(zeroReader{}, int64(a.Size))); err != nil {
+			return nil, err
+		}
+	}
+
+	var h gomessage.Header
+	for key, value := range m.Headers {
+		h.Set(key, value)
+	}
+	h.SetContentType("multipart/mixed", nil)
+	return gomessage.NewMultipart(h, parts)
+}
+
+// zeroReader reads an infinite stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// runFilterTests runs the test cases of all filters of the accounts, and writes
+// the results with a diff of failures to w. It returns the number of tests run
+// and failed.
+func runFilterTests(logger Logger, ctx context.Context, w io.Writer, config *config, accounts []*configAccount) (total, failed int, _ error) {
+	// Accounts without their own filters share the top-level ones, which only
+	// need to be tested once.
+	var tested []*configFilter
+	for _, account := range accounts {
+		if len(account.Filters) == 0 || slices.Contains(tested, &account.Filters[0]) {
+			continue
+		}
+		tested = append(tested, &account.Filters[0])
+
+		for i := range account.Filters {
+			f := &account.Filters[i]
+			for j := range f.Tests {
+				test := &f.Tests[j]
+				name := test.Name
+				if name == "" {
+					name = fmt.Sprintf("tests[%d]", j)
+				}
+				title := fmt.Sprintf("%q / %q", f.Name, name)
+				if len(accounts) > 1 {
+					title = fmt.Sprintf("%q / %s", account.Name, title)
+				}
+
+				msg, err := test.message()
+				if err != nil {
+					return total, failed, errors.Wrapf(err, "build message of %s", title)
+				}
+				mailbox := test.Mailbox
+				if mailbox == "" {
+					mailbox = account.Mailboxes[0]
+				}
+
+				total++
+				failures := checkFilterTest(test, f, evaluate(logger, ctx, config, account, mailbox, msg, true))
+				if len(failures) == 0 {
+					_, _ = fmt.Fprintf(w, "PASS %s\n", title)
+					continue
+				}
+				failed++
+				_, _ = fmt.Fprintf(w, "FAIL %s\n", title)
+				for _, failure := range failures {
+					_, _ = fmt.Fprintf(w, "    %s\n", strings.ReplaceAll(failure, "\n", "\n    "))
+				}
+			}
+		}
+	}
+	return total, failed, nil
+}
+
+// checkFilterTest returns the failures of the test case of the filter given the
+// evaluation result.
+func checkFilterTest(test *configFilterTest, f *configFilter, result *evaluation) []string {
+	matchedNames := make([]string, 0, len(result.matched))
+	for _, matched := range result.matched {
+		name := fmt.Sprintf("%q", matched.Name)
+		if matched.HaltOnMatch {
+			name += " (halt-on-match)"
+		}
+		matchedNames = append(matchedNames, name)
+	}
+	matchedSummary := "none"
+	if len(matchedNames) > 0 {
+		matchedSummary = strings.Join(matchedNames, ", ")
+	}
+
+	var failures []string
+	if test.Match != nil {
+		matched := slices.Contains(result.matched, f)
+		if matched && !*test.Match {
+			failures = append(failures, fmt.Sprintf("expected the filter not to match, matched filters: %s", matchedSummary))
+		} else if !matched && *test.Match {
+			failures = append(failures, fmt.Sprintf("expected the filter to match, matched filters: %s", matchedSummary))
+		}
+	}
+	if test.Actions != nil {
+		want := make([]string, len(test.Actions))
+		for i, action := range test.Actions {
+			want[i] = action.String()
+		}
+		got := make([]string, len(result.actions))
+		for i, action := range result.actions {
+			got[i] = action.String()
+		}
+		if !slices.Equal(want, got) {
+			failures = append(
+				failures,
+				fmt.Sprintf("actions differ (-want +got), matched filters: %s\n%s", matchedSummary, diffLines(want, got)),
+			)
+		}
+	}
+	return failures
+}
+
+// diffLines returns the line diff from a to b, with lines only in a prefixed by
+// "-", lines only in b prefixed by "+", and common lines prefixed by a space.
+func diffLines(a, b []string) string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and
+	// b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, "  "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "- "+a[i])
+			i++
+		default:
+			lines = append(lines, "+ "+b[j])
+			j++
+		}
+	}
+	return strings.Join(lines, "\n")
+}
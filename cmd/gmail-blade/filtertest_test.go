@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/charmbracelet/log"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want string
+	}{
+		{
+			name: "equal",
+			a:    []string{"archive", "read"},
+			b:    []string{"archive", "read"},
+			want: "  archive\n  read",
+		},
+		{
+			name: "removed and added",
+			a:    []string{`label "GitHub"`, "archive"},
+			b:    []string{"archive", "delete"},
+			want: "- label \"GitHub\"\n  archive\n+ delete",
+		},
+		{
+			name: "empty want",
+			a:    nil,
+			b:    []string{"delete"},
+			want: "+ delete",
+		},
+		{
+			name: "empty got",
+			a:    []string{"delete"},
+			b:    nil,
+			want: "- delete",
+		},
+		{
+			name: "both empty",
+			want: "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := diffLines(test.a, test.b); got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckFilterTest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gmail-blade.yml")
+	err := os.WriteFile(path, []byte(`
+credentials:
+  username: "jane@acme.com"
+filters:
+  - name: "Delete GitHub notifications"
+    condition: '"notifications@github.com" in message.from'
+    actions: [delete]
+    halt-on-match: true
+  - name: "Label pull requests"
+    condition: 'message.subject contains "Pull request"'
+    actions: ['label "GitHub"', archive]
+    tests:
+      - name: "Pull request from GitHub"
+        message:
+          from: ["notifications@github.com"]
+          subject: "Pull request opened"
+        match: true
+        actions: ['label "GitHub"', archive]
+      - name: "Pull request from elsewhere"
+        message:
+          from: ["joe@acme.com"]
+          subject: "Pull request opened"
+        match: true
+        actions: ['label "GitHub"', archive]
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(path, secretResolver{disabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &config.Accounts[0]
+	logger := log.New(io.Discard)
+
+	// The earlier halt-on-match filter eats the message expected to match.
+	f := &account.Filters[1]
+	test := &f.Tests[0]
+	msg, err := test.message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := checkFilterTest(test, f, evaluate(logger, context.Background(), config, account, "INBOX", msg, true))
+	want := []string{
+		`expected the filter to match, matched filters: "Delete GitHub notifications" (halt-on-match)`,
+		"actions differ (-want +got), matched filters: \"Delete GitHub notifications\" (halt-on-match)\n" +
+			"- label \"GitHub\"\n" +
+			"- archive\n" +
+			"+ delete",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got failures %q, want %q", got, want)
+	}
+
+	var out bytes.Buffer
+	total, failed, err := runFilterTests(logger, context.Background(), &out, config, []*configAccount{account})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || failed != 1 {
+		t.Fatalf("got %d total and %d failed, want 2 and 1", total, failed)
+	}
+	wantOut := `FAIL "Label pull requests" / "Pull request from GitHub"
+    expected the filter to match, matched filters: "Delete GitHub notifications" (halt-on-match)
+    actions differ (-want +got), matched filters: "Delete GitHub notifications" (halt-on-match)
+    - label "GitHub"
+    - archive
+    + delete
+PASS "Label pull requests" / "Pull request from elsewhere"
+`
+	if out.String() != wantOut {
+		t.Fatalf("got output\n%s\nwant\n%s", out.String(), wantOut)
+	}
+}
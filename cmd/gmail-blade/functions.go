@@ -0,0 +1,261 @@
+package main
+
+import (
+	"net/textproto"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/file"
+	"github.com/expr-lang/expr/vm"
+	"github.com/pkg/errors"
+)
+
+// conditionFunctions are the helper functions available in condition
+// expressions, each with a typed signature to be checked at compile time.
+var conditionFunctions = []expr.Option{
+	expr.Function(
+		"domain",
+		func(params ...any) (any, error) {
+			return addressDomain(params[0].(string)), nil
+		},
+		new(func(string) string),
+	),
+	expr.Function(
+		"matchesGlob",
+		func(params ...any) (any, error) {
+			return matchesGlob(params[0].(string), params[1].(string))
+		},
+		new(func(string, string) bool),
+	),
+	expr.Function(
+		"regexMatch",
+		func(params ...any) (any, error) {
+			re, err := cachedRegexp(params[1].(string))
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(params[0].(string)), nil
+		},
+		new(func(string, string) bool),
+	),
+	expr.Function(
+		"isNoreply",
+		func(params ...any) (any, error) {
+			return isNoreplyAddress(params[0].(string)), nil
+		},
+		new(func(string) bool),
+	),
+	expr.Function(
+		"anyFrom",
+		func(params ...any) (any, error) {
+			msg := params[0].(messageEnv)
+			for _, from := range msg.From {
+				for _, pattern := range params[1:] {
+					matched, err := matchesGlob(from, pattern.(string))
+					if err != nil || matched {
+						return matched, err
+					}
+				}
+			}
+			return false, nil
+		},
+		new(func(messageEnv, ...string) bool),
+	),
+	expr.Function(
+		"listId",
+		func(params ...any) (any, error) {
+			msg := params[0].(messageEnv)
+			if msg.ListID == "" {
+				return false, nil
+			}
+			for _, pattern := range params[1:] {
+				matched, err := matchesGlob(msg.ListID, pattern.(string))
+				if err != nil || matched {
+					return matched, err
+				}
+			}
+			return false, nil
+		},
+		new(func(messageEnv, ...string) bool),
+	),
+	expr.Function(
+		"hasHeader",
+		func(params ...any) (any, error) {
+			msg := params[0].(messageEnv)
+			_, ok := msg.Headers[textproto.CanonicalMIMEHeaderKey(params[1].(string))]
+			return ok, nil
+		},
+		new(func(messageEnv, string) bool),
+	),
+	expr.Function(
+		"olderThan",
+		func(params ...any) (any, error) {
+			msg := params[0].(messageEnv)
+			d, err := parseAge(params[1].(string))
+			if err != nil {
+				return nil, err
+			}
+			// Messages without a date, e.g. files without a Date header, are not
+			// known to be old.
+			if msg.Date.IsZero() {
+				return false, nil
+			}
+			return msg.Date.Before(time.Now().Add(-d)), nil
+		},
+		new(func(messageEnv, string) bool),
+	),
+	expr.Patch(messageArgPatcher{}),
+}
+
+// messageArgFunctions are the helper functions about the message, which are
+// called without the message in conditions, e.g. `anyFrom("*@github.com")`.
+var messageArgFunctions = []string{"anyFrom", "listId", "hasHeader", "olderThan"}
+
+// messageArgPatcher passes the message as the first argument to calls of
+// messageArgFunctions.
+type messageArgPatcher struct{}
+
+func (messageArgPatcher) Visit(node *ast.Node) {
+	call, ok := (*node).(*ast.CallNode)
+	if !ok {
+		return
+	}
+	callee, ok := call.Callee.(*ast.IdentifierNode)
+	if !ok || !slices.Contains(messageArgFunctions, callee.Value) {
+		return
+	}
+	call.Arguments = append([]ast.Node{&ast.IdentifierNode{Value: "message"}}, call.Arguments...)
+}
+
+// checkConstantArguments checks the patterns and durations passed as constants
+// to the functions in the compiled condition, so that invalid ones are reported
+// when loading the config instead of failing every evaluation. Regular
+// expressions are compiled into regexpCache in the meantime.
+func checkConstantArguments(program *vm.Program) error {
+	var err error
+	node := program.Node()
+	ast.Walk(&node, visitorFunc(func(node *ast.Node) {
+		call, ok := (*node).(*ast.CallNode)
+		if !ok || err != nil {
+			return
+		}
+		callee, ok := call.Callee.(*ast.IdentifierNode)
+		if !ok {
+			return
+		}
+		for i, arg := range call.Arguments {
+			s, ok := arg.(*ast.StringNode)
+			if !ok {
+				continue
+			}
+
+			var argErr error
+			switch {
+			case callee.Value == "regexMatch" && i == 1:
+				var re *regexp.Regexp
+				re, argErr = compileRegexp(s.Value)
+				if argErr == nil {
+					regexpCache.Store(s.Value, re)
+				}
+			case callee.Value == "matchesGlob" && i == 1,
+				callee.Value == "anyFrom",
+				callee.Value == "listId":
+				_, argErr = matchesGlob("", s.Value)
+			case callee.Value == "olderThan":
+				_, argErr = parseAge(s.Value)
+			}
+			if argErr != nil {
+				err = (&file.Error{Location: s.Location(), Message: argErr.Error()}).Bind(program.Source())
+				return
+			}
+		}
+	}))
+	return err
+}
+
+type visitorFunc func(node *ast.Node)
+
+func (f visitorFunc) Visit(node *ast.Node) { f(node) }
+
+// addressDomain returns the lowercase domain of the email address, e.g.
+// "github.com" of "notifications@GitHub.com".
+func addressDomain(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(addr[at+1:])
+}
+
+// matchesGlob reports whether s matches the case-insensitive glob pattern, where
+// "*" matches any sequence of characters and "?" matches any single character,
+// e.g. "*@github.com".
+func matchesGlob(s, pattern string) (bool, error) {
+	// Unlike paths, "*" should also match slashes in addresses and list IDs.
+	s = strings.ReplaceAll(strings.ToLower(s), "/", "\x00")
+	// Brackets are literal, e.g. "[sentry] *" for subjects, rather than the
+	// character classes of path.Match.
+	pattern = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, "/", "\x00").Replace(strings.ToLower(pattern))
+	matched, err := path.Match(pattern, s)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid glob pattern %q", pattern)
+	}
+	return matched, nil
+}
+
+// regexpCache caches compiled regular expressions by their patterns. Only the
+// constants of conditions are cached when loading the config, see
+// checkConstantArguments, so that patterns from message fields cannot grow the
+// cache without limit in the server.
+var regexpCache sync.Map // map[string]*regexp.Regexp
+
+// cachedRegexp returns the cached regular expression of the pattern, or
+// compiles it without caching.
+func cachedRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexpCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	return compileRegexp(pattern)
+}
+
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid regular expression %q", pattern)
+	}
+	return re, nil
+}
+
+// isNoreplyAddress reports whether the email address looks like one that does
+// not accept replies, e.g. "noreply@", "no-reply@", "do_not_reply@" and
+// "@noreply.github.com".
+func isNoreplyAddress(addr string) bool {
+	addr = strings.NewReplacer("-", "", "_", "", ".", "").Replace(strings.ToLower(addr))
+	return strings.Contains(addr, "noreply") || strings.Contains(addr, "donotreply")
+}
+
+// parseAge parses durations like time.ParseDuration, with additional units "d"
+// for days and "w" for weeks, e.g. "7d".
+func parseAge(s string) (time.Duration, error) {
+	for unit, d := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, unit); ok {
+			v, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return 0, errors.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(v * float64(d)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
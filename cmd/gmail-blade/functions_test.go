@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/expr-lang/expr"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{s: "7d", want: 7 * 24 * time.Hour},
+		{s: "2w", want: 14 * 24 * time.Hour},
+		{s: "1.5d", want: 36 * time.Hour},
+		{s: "36h", want: 36 * time.Hour},
+		{s: "90m", want: 90 * time.Minute},
+		{s: "d", wantErr: true},
+		{s: "7x", wantErr: true},
+		{s: "7 d", wantErr: true},
+		{s: "", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseAge(test.s)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseAge(%q) = %v, want an error", test.s, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseAge(%q) = %v, %v, want %v", test.s, got, err, test.want)
+		}
+	}
+}
+
+func TestMatchesGlob(t *testing.T) {
+	tests := []struct {
+		s, pattern string
+		want       bool
+	}{
+		{s: "notifications@GitHub.com", pattern: "*@github.com", want: true},
+		{s: "notifications@github.com", pattern: "*@GITHUB.COM", want: true},
+		{s: "notifications@github.com.evil.com", pattern: "*@github.com", want: false},
+		{s: "ab@x.com", pattern: "a?@x.com", want: true},
+		{s: "a@x.com", pattern: "a?@x.com", want: false},
+		// Brackets and other regular expression metacharacters are literal.
+		{s: "[Sentry] Error in production", pattern: "[sentry] *", want: true},
+		{s: "s Error in production", pattern: "[sentry] *", want: false},
+		{s: "Re: a.b+c (1)", pattern: "re: a.b+c (?)", want: true},
+		{s: "Re: axb+c (1)", pattern: "re: a.b+c (?)", want: false},
+		{s: `C:\Users`, pattern: `c:\*`, want: true},
+		// "*" also matches slashes.
+		{s: "repo/name <repo.github.com>", pattern: "*<*.github.com>", want: true},
+	}
+	for _, test := range tests {
+		got, err := matchesGlob(test.s, test.pattern)
+		if err != nil || got != test.want {
+			t.Errorf("matchesGlob(%q, %q) = %v, %v, want %v", test.s, test.pattern, got, err, test.want)
+		}
+	}
+}
+
+func TestIsNoreplyAddress(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"noreply@github.com":            true,
+		"No-Reply@accounts.google.com":  true,
+		"do_not_reply@vendor.com":       true,
+		"do.not.reply@vendor.com":       true,
+		"jane@users.noreply.github.com": true,
+		"notifications@github.com":      false,
+		"reply@vendor.com":              false,
+		"":                              false,
+	} {
+		if got := isNoreplyAddress(addr); got != want {
+			t.Errorf("isNoreplyAddress(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestAddressDomain(t *testing.T) {
+	for addr, want := range map[string]string{
+		"notifications@GitHub.com": "github.com",
+		"a@b@Example.com":          "example.com",
+		"@example.com":             "example.com",
+		"jane@":                    "",
+		"jane":                     "",
+		"":                         "",
+	} {
+		if got := addressDomain(addr); got != want {
+			t.Errorf("addressDomain(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestOlderThan(t *testing.T) {
+	program, err := compileCondition(`olderThan("1d")`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		date time.Time
+		want bool
+	}{
+		{name: "old", date: time.Now().Add(-48 * time.Hour), want: true},
+		{name: "new", date: time.Now().Add(-time.Hour), want: false},
+		{name: "no date", date: time.Time{}, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := expr.Run(program, conditionEnv{Message: messageEnv{Date: test.date}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -13,21 +13,13 @@ import (
 	"golang.org/x/oauth2"
 )
 
-// githubPullRequest contains GitHub pull request of an email notification.
+// githubPullRequest contains GitHub pull request of an email notification. It
+// is also the "githubPullRequest" of condition expressions.
 type githubPullRequest struct {
-	Owner  string `json:"owner"`
-	Repo   string `json:"repo"`
-	Number int    `json:"number"`
-	Author string `json:"author"`
-}
-
-func (pr *githubPullRequest) Env() map[string]any {
-	return map[string]any{
-		"owner":  pr.Owner,
-		"repo":   pr.Repo,
-		"number": pr.Number,
-		"author": pr.Author,
-	}
+	Owner  string `json:"owner" expr:"owner"`
+	Repo   string `json:"repo" expr:"repo"`
+	Number int    `json:"number" expr:"number"`
+	Author string `json:"author" expr:"author"`
 }
 
 // GitHub pull request URLs follow the pattern: https://github.com/owner/repo/pull/123
@@ -98,7 +90,7 @@ func executePrefetchGitHubPullRequest(logger Logger, ctx context.Context, config
 }
 
 // processGitHubReview handles the "github review" action with prefetch data.
-func processGitHubReview(logger Logger, ctx context.Context, config configGitHub, uid imap.UID, prefetchData map[string]enver) error {
+func processGitHubReview(logger Logger, ctx context.Context, config configGitHub, uid imap.UID, prefetchData map[string]any) error {
 	prData, ok := prefetchData[prefetchGitHubPullRequestKey].(*githubPullRequest)
 	if !ok {
 		return errors.New("invalid GitHub pull request prefetch data type")
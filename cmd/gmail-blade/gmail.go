@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/pkg/errors"
+)
+
+// gmailCapability is advertised by IMAP servers that support the Gmail IMAP
+// extensions, see https://developers.google.com/workspace/gmail/imap/imap-extensions.
+const gmailCapability imap.Cap = "X-GM-EXT-1"
+
+const gmailCommandTimeout = time.Minute
+
+// gmailClient is a minimal IMAP client for the Gmail IMAP extensions, which are
+// not supported by go-imap. It lazily opens its own connection next to the main
+// client on first use, and only implements the few commands gmail-blade needs.
+//
+// The connection costs a second login next to the main client, because go-imap
+// has no way to send the extension commands over the main connection. It is
+// kept for as long as the IDLE session, and across polls by the polling server,
+// so only the main connection logs in again on every poll. It may go stale
+// while unused, e.g. during IDLE on the main connection or between polls, so
+// commands reconnect once on network errors.
+type gmailClient struct {
+	endpoint    configIMAP
+	credentials configCredentials
+
+	conn     net.Conn
+	r        *bufio.Reader
+	tag      int
+	selected string
+}
+
+func newGmailClient(endpoint configIMAP, credentials configCredentials) *gmailClient {
+	return &gmailClient{
+		endpoint:    endpoint,
+		credentials: credentials,
+	}
+}
+
+// Close logs out and closes the connection, if any. It is safe to call on a nil
+// client.
+func (c *gmailClient) Close() error {
+	if c == nil || c.conn == nil {
+		return nil
+	}
+	_, _ = c.execute("LOGOUT")
+	// A stale connection is already closed by the failed LOGOUT, see reset.
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	c.selected = ""
+	return err
+}
+
+func (c *gmailClient) connect() error {
+	var tlsConfig *tls.Config
+	if c.endpoint.Security != imapSecurityPlain {
+		var err error
+		tlsConfig, err = c.endpoint.tlsConfig()
+		if err != nil {
+			return errors.Wrap(err, "build TLS config")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if c.endpoint.Security == imapSecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.endpoint.address(), tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.endpoint.address())
+	}
+	if err != nil {
+		return errors.Wrap(err, "dial IMAP server")
+	}
+	c.conn = conn
+	c.r = bufio.NewReader(conn)
+
+	err = c.handshake(tlsConfig)
+	if err != nil {
+		if c.conn != nil {
+			_ = c.reset(err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *gmailClient) handshake(tlsConfig *tls.Config) error {
+	_ = c.conn.SetDeadline(time.Now().Add(gmailCommandTimeout))
+	greeting, _, err := c.readResponse()
+	if err != nil {
+		return errors.Wrap(err, "read greeting")
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		return errors.Errorf("unexpected greeting %q", greeting)
+	}
+
+	if c.endpoint.Security == imapSecurityStartTLS {
+		if _, err = c.execute("STARTTLS"); err != nil {
+			return errors.Wrap(err, "start TLS")
+		}
+		c.conn = tls.Client(c.conn, tlsConfig)
+		c.r = bufio.NewReader(c.conn)
+	}
+	return c.authenticate()
+}
+
+func (c *gmailClient) authenticate() error {
+	responses, err := c.execute("CAPABILITY")
+	if err != nil {
+		return errors.Wrap(err, "get capabilities")
+	}
+	caps := make(imap.CapSet)
+	for _, resp := range responses {
+		fields := strings.Fields(resp.line)
+		if len(fields) > 1 && strings.EqualFold(fields[1], "CAPABILITY") {
+			for _, name := range fields[2:] {
+				caps[imap.Cap(name)] = struct{}{}
+			}
+		}
+	}
+
+	if c.credentials.OAuth2.tokenSource != nil {
+		token, err := c.credentials.OAuth2.tokenSource.Token()
+		if err != nil {
+			return errors.Wrap(err, "get OAuth2 access token")
+		}
+		mech, ir, err := newOAuth2SASLClient(caps, c.credentials.Username, token.AccessToken).Start()
+		if err != nil {
+			return errors.Wrap(err, "start SASL authentication")
+		}
+		_, err = c.execute("AUTHENTICATE " + mech + " " + base64.StdEncoding.EncodeToString(ir))
+		if err != nil {
+			return errors.Wrap(err, "authenticate to IMAP server")
+		}
+	} else {
+		_, err = c.execute("LOGIN " + quoteIMAPString(c.credentials.Username) + " " + quoteIMAPString(c.credentials.Password))
+		if err != nil {
+			return errors.Wrap(err, "login to IMAP server")
+		}
+	}
+
+	// Allow label and mailbox names to be sent and received as UTF-8 instead of
+	// modified UTF-7.
+	if caps.Has(imap.CapUTF8Accept) {
+		_, err = c.execute("ENABLE UTF8=ACCEPT")
+		if err != nil {
+			return errors.Wrap(err, "enable UTF-8")
+		}
+	}
+	return nil
+}
+
+// selectMailbox connects to the server if not yet connected, and selects the
+// mailbox if it is not already selected.
+func (c *gmailClient) selectMailbox(mailbox string) error {
+	if c.conn == nil {
+		err := c.connect()
+		if err != nil {
+			return err
+		}
+	}
+	if c.selected == mailbox {
+		return nil
+	}
+	_, err := c.execute("SELECT " + quoteIMAPString(mailbox))
+	if err != nil {
+		return errors.Wrapf(err, "select mailbox %q", mailbox)
+	}
+	c.selected = mailbox
+	return nil
+}
+
+// fetch returns the requested items of the messages in the mailbox, keyed by
+// the UID and then the item name, e.g. "X-GM-LABELS".
+func (c *gmailClient) fetch(mailbox string, uids []imap.UID, items ...string) (map[imap.UID]map[string]any, error) {
+	responses, err := c.executeIn(mailbox, fmt.Sprintf("UID FETCH %s (UID %s)", imap.UIDSetNum(uids...), strings.Join(items, " ")))
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch")
+	}
+
+	messages := make(map[imap.UID]map[string]any, len(uids))
+	for _, resp := range responses {
+		// * 12 FETCH (X-GM-LABELS (\Inbox "GitHub") UID 34)
+		fields := strings.SplitN(resp.line, " ", 4)
+		if len(fields) < 4 || !strings.EqualFold(fields[2], "FETCH") {
+			continue
+		}
+		p := &imapParser{s: fields[3], literals: resp.literals}
+		value, err := p.value()
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse FETCH response %q", resp.line)
+		}
+		list, ok := value.([]any)
+		if !ok || len(list)%2 != 0 {
+			return nil, errors.Errorf("malformed FETCH response %q", resp.line)
+		}
+		attrs := make(map[string]any, len(list)/2)
+		for i := 0; i < len(list); i += 2 {
+			name, _ := list[i].(string)
+			attrs[strings.ToUpper(name)] = list[i+1]
+		}
+		uidStr, _ := attrs["UID"].(string)
+		uid, err := strconv.ParseUint(uidStr, 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse UID of FETCH response %q", resp.line)
+		}
+		messages[imap.UID(uid)] = attrs
+	}
+	return messages, nil
+}
+
+// gmailAttributes is the Gmail-specific attributes of a message.
+type gmailAttributes struct {
+	// Labels is the Gmail labels of the message, where system labels are
+	// prefixed with a backslash, e.g. "\Important".
+	Labels   []string
+	ThreadID string
+}
+
+// fetchAttributes returns the Gmail attributes of the messages in the mailbox,
+// keyed by the UID.
+func (c *gmailClient) fetchAttributes(mailbox string, uids []imap.UID) (map[imap.UID]gmailAttributes, error) {
+	messages, err := c.fetch(mailbox, uids, "X-GM-LABELS", "X-GM-THRID")
+	if err != nil {
+		return nil, err
+	}
+	attributes := make(map[imap.UID]gmailAttributes, len(messages))
+	for uid, attrs := range messages {
+		list, _ := attrs["X-GM-LABELS"].([]any)
+		labels := make([]string, 0, len(list))
+		for _, label := range list {
+			if s, ok := label.(string); ok {
+				labels = append(labels, s)
+			}
+		}
+		threadID, _ := attrs["X-GM-THRID"].(string)
+		attributes[uid] = gmailAttributes{
+			Labels:   labels,
+			ThreadID: threadID,
+		}
+	}
+	return attributes, nil
+}
+
+// searchThread returns the UIDs of the messages of the thread in the mailbox.
+func (c *gmailClient) searchThread(mailbox, threadID string) ([]imap.UID, error) {
+	return c.search(mailbox, "X-GM-THRID "+threadID)
+}
+
+// searchRaw returns the UIDs of the messages in the mailbox after the given UID
+// that match the Gmail search query, e.g. "from:github.com newer_than:1d". Only
+// unread messages are returned when unseen is true.
+func (c *gmailClient) searchRaw(mailbox string, after imap.UID, unseen bool, query string) ([]imap.UID, error) {
+	criteria := fmt.Sprintf("UID %d:*", after+1)
+	if unseen {
+		criteria += " UNSEEN"
+	}
+	uids, err := c.search(mailbox, criteria+" X-GM-RAW "+quoteIMAPString(query))
+	if err != nil {
+		return nil, err
+	}
+	// See processMailbox for why "n:*" may match the UID before n.
+	return slices.DeleteFunc(uids, func(uid imap.UID) bool {
+		return uid <= after
+	}), nil
+}
+
+// search returns the UIDs of the messages in the mailbox that match the IMAP
+// search criteria.
+func (c *gmailClient) search(mailbox, criteria string) ([]imap.UID, error) {
+	responses, err := c.executeIn(mailbox, "UID SEARCH "+criteria)
+	if err != nil {
+		return nil, errors.Wrap(err, "search")
+	}
+	var uids []imap.UID
+	for _, resp := range responses {
+		// * SEARCH 12 34
+		fields := strings.Fields(resp.line)
+		if len(fields) < 2 || !strings.EqualFold(fields[1], "SEARCH") {
+			continue
+		}
+		for _, field := range fields[2:] {
+			uid, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse SEARCH response %q", resp.line)
+			}
+			uids = append(uids, imap.UID(uid))
+		}
+	}
+	return uids, nil
+}
+
+// storeLabels adds (when add is true) or removes the Gmail labels of the
+// messages in the mailbox.
+func (c *gmailClient) storeLabels(mailbox string, uids []imap.UID, add bool, labels ...string) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	op := "-"
+	if add {
+		op = "+"
+	}
+	quoted := make([]string, 0, len(labels))
+	for _, label := range labels {
+		// System labels like "\Inbox" must be sent as atoms, quoting them would
+		// refer to user labels with a literal backslash instead.
+		if gmailSystemLabelRegexp.MatchString(label) {
+			quoted = append(quoted, label)
+		} else {
+			quoted = append(quoted, quoteIMAPString(label))
+		}
+	}
+	_, err := c.executeIn(mailbox, fmt.Sprintf("UID STORE %s %sX-GM-LABELS.SILENT (%s)", imap.UIDSetNum(uids...), op, strings.Join(quoted, " ")))
+	return err
+}
+
+var gmailSystemLabelRegexp = regexp.MustCompile(`^\\[A-Za-z]+$`)
+
+// imapResponse is an untagged response line, where literals are left as their
+// "{n}" markers in line and their contents are stored in literals in order.
+type imapResponse struct {
+	line     string
+	literals []string
+}
+
+// executeIn selects the mailbox and executes the command, which must be safe to
+// send twice. A stale connection that fails with a network error is reconnected
+// and the command retried once.
+func (c *gmailClient) executeIn(mailbox, command string) ([]imapResponse, error) {
+	reused := c.conn != nil
+	responses, err := c.selectAndExecute(mailbox, command)
+	// The connection is only reset on network errors, see reset.
+	if err != nil && reused && c.conn == nil {
+		responses, err = c.selectAndExecute(mailbox, command)
+	}
+	return responses, err
+}
+
+func (c *gmailClient) selectAndExecute(mailbox, command string) ([]imapResponse, error) {
+	err := c.selectMailbox(mailbox)
+	if err != nil {
+		return nil, err
+	}
+	return c.execute(command)
+}
+
+// execute sends the command and returns the untagged responses once the server
+// completes it.
+func (c *gmailClient) execute(command string) ([]imapResponse, error) {
+	c.tag++
+	tag := "G" + strconv.Itoa(c.tag)
+	_ = c.conn.SetDeadline(time.Now().Add(gmailCommandTimeout))
+	if _, err := io.WriteString(c.conn, tag+" "+command+"\r\n"); err != nil {
+		return nil, c.reset(err)
+	}
+
+	var responses []imapResponse
+	for {
+		line, literals, err := c.readResponse()
+		if err != nil {
+			return nil, c.reset(err)
+		}
+		switch {
+		case strings.HasPrefix(line, "+"):
+			// Only failed SASL exchanges send continuation requests, an empty
+			// response makes the server complete the command with the error.
+			if _, err = io.WriteString(c.conn, "\r\n"); err != nil {
+				return nil, c.reset(err)
+			}
+		case strings.HasPrefix(line, "* "):
+			responses = append(responses, imapResponse{line: line, literals: literals})
+		case strings.HasPrefix(line, tag+" "):
+			status := strings.TrimPrefix(line, tag+" ")
+			if !strings.HasPrefix(strings.ToUpper(status), "OK") {
+				return nil, errors.New("imap: " + status)
+			}
+			return responses, nil
+		}
+	}
+}
+
+// reset closes the connection after a network error, so that the next command
+// reconnects instead of reusing a broken connection.
+func (c *gmailClient) reset(err error) error {
+	_ = c.conn.Close()
+	c.conn = nil
+	c.selected = ""
+	// The server closing the connection in the middle of a command is reported
+	// as "unexpected EOF" like the main client, see isTransientError.
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+var imapLiteralSuffixRegexp = regexp.MustCompile(`\{(\d+)\+?\}$`)
+
+// readResponse reads a response line including any literals.
+func (c *gmailClient) readResponse() (line string, literals []string, _ error) {
+	var b strings.Builder
+	for {
+		s, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		s = strings.TrimRight(s, "\r\n")
+		b.WriteString(s)
+
+		match := imapLiteralSuffixRegexp.FindStringSubmatch(s)
+		if match == nil {
+			return b.String(), literals, nil
+		}
+		size, err := strconv.Atoi(match[1])
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "parse literal size %q", match[1])
+		}
+		literal := make([]byte, size)
+		if _, err = io.ReadFull(c.r, literal); err != nil {
+			return "", nil, err
+		}
+		literals = append(literals, string(literal))
+	}
+}
+
+// quoteIMAPString returns s as an IMAP quoted string.
+func quoteIMAPString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// imapParser parses atoms, quoted strings, literals and parenthesized lists of
+// IMAP responses. Atoms and strings are returned as string, lists as []any and
+// NIL as nil.
+type imapParser struct {
+	s        string
+	pos      int
+	literals []string
+}
+
+func (p *imapParser) value() (any, error) {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+	if p.pos >= len(p.s) {
+		return nil, errors.New("unexpected end of response")
+	}
+
+	switch p.s[p.pos] {
+	case '(':
+		p.pos++
+		list := []any{}
+		for {
+			for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+				p.pos++
+			}
+			if p.pos >= len(p.s) {
+				return nil, errors.New("unterminated list")
+			}
+			if p.s[p.pos] == ')' {
+				p.pos++
+				return list, nil
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+
+	case '"':
+		p.pos++
+		var b strings.Builder
+		for p.pos < len(p.s) {
+			c := p.s[p.pos]
+			p.pos++
+			switch c {
+			case '\\':
+				if p.pos < len(p.s) {
+					b.WriteByte(p.s[p.pos])
+					p.pos++
+				}
+			case '"':
+				return b.String(), nil
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return nil, errors.New("unterminated quoted string")
+
+	case '{':
+		end := strings.IndexByte(p.s[p.pos:], '}')
+		if end < 0 {
+			return nil, errors.New("unterminated literal")
+		}
+		p.pos += end + 1
+		if len(p.literals) == 0 {
+			return nil, errors.New("missing literal")
+		}
+		literal := p.literals[0]
+		p.literals = p.literals[1:]
+		return literal, nil
+
+	default:
+		start := p.pos
+		for p.pos < len(p.s) && !strings.ContainsRune(" ()", rune(p.s[p.pos])) {
+			p.pos++
+		}
+		atom := p.s[start:p.pos]
+		if strings.EqualFold(atom, "NIL") {
+			return nil, nil
+		}
+		return atom, nil
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestIMAPParser(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        string
+		literals []string
+		want     any
+		wantErr  string
+	}{
+		{
+			name: "atom",
+			s:    "12345",
+			want: "12345",
+		},
+		{
+			name: "NIL",
+			s:    "nil",
+			want: nil,
+		},
+		{
+			name: "quoted string with escapes",
+			s:    `"Say \"hi\" to a\\b"`,
+			want: `Say "hi" to a\b`,
+		},
+		{
+			name: "nested lists",
+			s:    `(X-GM-LABELS (\Inbox "GitHub" ()) UID 34)`,
+			want: []any{"X-GM-LABELS", []any{`\Inbox`, "GitHub", []any{}}, "UID", "34"},
+		},
+		{
+			name:     "literals in order",
+			s:        `(X-GM-LABELS ({5} \Important {11}) UID 7)`,
+			literals: []string{"a(b)c", `with "quote`},
+			want:     []any{"X-GM-LABELS", []any{"a(b)c", `\Important`, `with "quote`}, "UID", "7"},
+		},
+		{
+			name:    "unterminated list",
+			s:       `(UID 7`,
+			wantErr: "unterminated list",
+		},
+		{
+			name:    "unterminated quoted string",
+			s:       `"GitHub`,
+			wantErr: "unterminated quoted string",
+		},
+		{
+			name:    "missing literal",
+			s:       `{5}`,
+			wantErr: "missing literal",
+		},
+		{
+			name:    "empty",
+			s:       " ",
+			wantErr: "unexpected end of response",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &imapParser{s: test.s, literals: test.literals}
+			got, err := p.value()
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQuoteIMAPString(t *testing.T) {
+	for s, want := range map[string]string{
+		"GitHub":      `"GitHub"`,
+		`Say "hi"`:    `"Say \"hi\""`,
+		`\Inbox`:      `"\\Inbox"`,
+		"Café/Bücher": `"Café/Bücher"`,
+	} {
+		if got := quoteIMAPString(s); got != want {
+			t.Errorf("quoteIMAPString(%q) = %s, want %s", s, got, want)
+		}
+		// Quoted strings must read back as the original string.
+		got, err := (&imapParser{s: quoteIMAPString(s)}).value()
+		if err != nil || got != s {
+			t.Errorf("parse %s = %q, %v, want %q", quoteIMAPString(s), got, err, s)
+		}
+	}
+}
+
+// fakeIMAPServer serves the connection by answering each command with the
+// untagged responses of the first handler whose prefix matches the command
+// without its tag, and completes it with OK. Commands are recorded without
+// their tags. The connection is closed without a response for commands that
+// have no handler.
+type fakeIMAPServer struct {
+	handlers [][2]string
+	commands chan string
+}
+
+func newFakeIMAPServer(handlers ...[2]string) *fakeIMAPServer {
+	return &fakeIMAPServer{
+		handlers: handlers,
+		commands: make(chan string, 100),
+	}
+}
+
+func (s *fakeIMAPServer) serve(conn net.Conn, greet bool) {
+	defer func() { _ = conn.Close() }()
+	if greet {
+		_, _ = conn.Write([]byte("* OK ready\r\n"))
+	}
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, command, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		s.commands <- command
+
+		handled := false
+		for _, h := range s.handlers {
+			if strings.HasPrefix(command, h[0]) {
+				_, _ = conn.Write([]byte(h[1] + tag + " OK done\r\n"))
+				handled = true
+				break
+			}
+		}
+		if !handled {
+			return
+		}
+	}
+}
+
+// recorded returns the commands received so far.
+func (s *fakeIMAPServer) recorded() []string {
+	var commands []string
+	for {
+		select {
+		case command := <-s.commands:
+			commands = append(commands, command)
+		default:
+			return commands
+		}
+	}
+}
+
+// newPipeGmailClient returns a client that is already connected to the server
+// over a net.Pipe.
+func newPipeGmailClient(server *fakeIMAPServer) *gmailClient {
+	clientConn, serverConn := net.Pipe()
+	go server.serve(serverConn, false)
+	return &gmailClient{
+		conn: clientConn,
+		r:    bufio.NewReader(clientConn),
+	}
+}
+
+func TestGmailClientStoreLabels(t *testing.T) {
+	server := newFakeIMAPServer(
+		[2]string{"SELECT ", ""},
+		[2]string{"UID STORE ", ""},
+	)
+	client := newPipeGmailClient(server)
+	defer func() { _ = client.Close() }()
+
+	err := client.storeLabels("[Gmail]/All Mail", []imap.UID{3, 4, 5, 9}, true, `\Inbox`, `Say "hi"`, `a\b`, `\Not a system label`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.storeLabels("[Gmail]/All Mail", []imap.UID{3}, false, `\Important`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`SELECT "[Gmail]/All Mail"`,
+		`UID STORE 3:5,9 +X-GM-LABELS.SILENT (\Inbox "Say \"hi\"" "a\\b" "\\Not a system label")`,
+		`UID STORE 3 -X-GM-LABELS.SILENT (\Important)`,
+	}
+	if got := server.recorded(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got commands %q, want %q", got, want)
+	}
+}
+
+func TestGmailClientFetchAttributes(t *testing.T) {
+	// Literals may contain anything, including line breaks and parentheses.
+	literal := "line\r\n\"break (X-GM-LABELS"
+	server := newFakeIMAPServer(
+		[2]string{"SELECT ", "* 3 EXISTS\r\n"},
+		[2]string{"UID FETCH ", "" +
+			"* 1 FETCH (X-GM-LABELS (\\Inbox {" + strconv.Itoa(len(literal)) + "}\r\n" + literal + " \"GitHub\") X-GM-THRID 1234 UID 7)\r\n" +
+			"* 2 FETCH (UID 8 X-GM-THRID 5678 X-GM-LABELS ())\r\n" +
+			"* 3 FLAGS (\\Seen)\r\n",
+		},
+	)
+	client := newPipeGmailClient(server)
+	defer func() { _ = client.Close() }()
+
+	got, err := client.fetchAttributes("INBOX", []imap.UID{7, 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[imap.UID]gmailAttributes{
+		7: {Labels: []string{`\Inbox`, literal, "GitHub"}, ThreadID: "1234"},
+		8: {Labels: []string{}, ThreadID: "5678"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestGmailClientSearchRaw(t *testing.T) {
+	server := newFakeIMAPServer(
+		[2]string{"SELECT ", ""},
+		// "n:*" matches the highest UID even when it is before n.
+		[2]string{"UID SEARCH ", "* SEARCH 10 12 13\r\n"},
+	)
+	client := newPipeGmailClient(server)
+	defer func() { _ = client.Close() }()
+
+	got, err := client.searchRaw("INBOX", 10, true, `from:"Jane Doe" subject:\n`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []imap.UID{12, 13}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got UIDs %v, want %v", got, want)
+	}
+	want := []string{
+		`SELECT "INBOX"`,
+		`UID SEARCH UID 11:* UNSEEN X-GM-RAW "from:\"Jane Doe\" subject:\\n"`,
+	}
+	if got := server.recorded(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got commands %q, want %q", got, want)
+	}
+}
+
+func TestGmailClientRetryFails(t *testing.T) {
+	server := newFakeIMAPServer([2]string{"SELECT ", ""})
+	client := newPipeGmailClient(server)
+	client.endpoint = configIMAP{Host: "127.0.0.1", Port: 0, Security: imapSecurityPlain}
+	defer func() { _ = client.Close() }()
+
+	// The fake server closes the connection on the unknown command, and the
+	// reconnect of the retry fails.
+	_, err := client.search("INBOX", "ALL")
+	if err == nil || !strings.Contains(err.Error(), "dial IMAP server") {
+		t.Fatalf("got error %v, want the error of the reconnect", err)
+	}
+	if client.conn != nil {
+		t.Fatal("connection is not reset after a network error")
+	}
+	want := []string{`SELECT "INBOX"`, "UID SEARCH ALL"}
+	if got := server.recorded(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got commands %q, want %q", got, want)
+	}
+}
+
+func TestGmailClientRetryOnStaleConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	server := newFakeIMAPServer(
+		[2]string{"CAPABILITY", "* CAPABILITY IMAP4rev1 X-GM-EXT-1\r\n"},
+		[2]string{"LOGIN ", ""},
+		[2]string{"SELECT ", ""},
+		[2]string{"UID SEARCH ", "* SEARCH 42\r\n"},
+	)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, true)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	client := newGmailClient(
+		configIMAP{Host: host, Port: portNum, Security: imapSecurityPlain},
+		configCredentials{Username: "jane@acme.com", Password: `pa"ss`},
+	)
+	defer func() { _ = client.Close() }()
+
+	uids, err := client.searchThread("[Gmail]/All Mail", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []imap.UID{42}; !reflect.DeepEqual(uids, want) {
+		t.Fatalf("got UIDs %v, want %v", uids, want)
+	}
+
+	// The server drops the idle connection, e.g. after a timeout, so the next
+	// command reconnects, selects the mailbox again and is retried once.
+	stale := client.conn
+	_ = stale.Close()
+	uids, err = client.searchThread("[Gmail]/All Mail", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []imap.UID{42}; !reflect.DeepEqual(uids, want) {
+		t.Fatalf("got UIDs %v, want %v", uids, want)
+	}
+	if client.conn == stale {
+		t.Fatal("stale connection is reused")
+	}
+
+	login := []string{
+		"CAPABILITY",
+		`LOGIN "jane@acme.com" "pa\"ss"`,
+		`SELECT "[Gmail]/All Mail"`,
+		"UID SEARCH X-GM-THRID 1234",
+	}
+	if got, want := server.recorded(), append(login, login...); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got commands %q, want %q", got, want)
+	}
+}
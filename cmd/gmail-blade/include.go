@@ -0,0 +1,217 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// configFragment is a file included by the config file, which adds definitions
+// and filters to the top-level ones, or to the ones of an account when included
+// by the account, and may include other files in turn.
+type configFragment struct {
+	Include     []string                    `yaml:"include"`
+	Definitions map[string]configDefinition `yaml:"definitions"`
+	Filters     []configFilter              `yaml:"filters"`
+}
+
+// includeConfigFiles merges the definitions and filters of the files included
+// by the config file at path into c. Filters of files included at the top level
+// are merged into the top-level filters, and those of files included by an
+// account into the filters of the account, which are the top-level ones when
+// the account has no filters of its own. Filters of each file come after the
+// ones of the file including it, and included files are merged depth-first in
+// the order of the include patterns, with matches of each pattern sorted by
+// name. Files included more than once by the top level or the same account are
+// only merged the first time. Definitions are shared by all accounts, so they
+// must be unique across files, and those of a file included by several
+// accounts are only merged once.
+func includeConfigFiles(c *config, path string) error {
+	if c.Definitions == nil {
+		c.Definitions = make(map[string]configDefinition)
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	fragments := make(map[string]*configFragment)
+
+	merge := func(patterns []string, filters *[]configFilter) error {
+		included := map[string]bool{absPath: true}
+
+		var include func(patterns []string, dir string) error
+		include = func(patterns []string, dir string) error {
+			for _, pattern := range patterns {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(dir, pattern)
+				}
+				files, err := globConfigFiles(pattern)
+				if err != nil {
+					return errors.Wrapf(err, "include %q", pattern)
+				}
+
+				for _, file := range files {
+					absFile, err := filepath.Abs(file)
+					if err != nil {
+						return err
+					}
+					if included[absFile] {
+						continue
+					}
+					included[absFile] = true
+
+					fragment, ok := fragments[absFile]
+					if !ok {
+						fragment, err = readConfigFragment(file)
+						if err != nil {
+							return err
+						}
+						fragments[absFile] = fragment
+
+						for name, d := range fragment.Definitions {
+							if existing, ok := c.Definitions[name]; ok {
+								return errors.Errorf("%s: definition %q is already defined at %s", d.position(), name, existing.position())
+							}
+							c.Definitions[name] = d
+						}
+					}
+					// Duplicate filter names are checked after merging, see
+					// checkDuplicateFilters.
+					*filters = append(*filters, fragment.Filters...)
+
+					err = include(fragment.Include, filepath.Dir(file))
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		return include(patterns, c.dir)
+	}
+
+	err = merge(c.Include, &c.Filters)
+	if err != nil {
+		return err
+	}
+	for i := range c.Accounts {
+		account := &c.Accounts[i]
+		// The included filters are added to the top-level filters the account
+		// would otherwise fall back to, instead of silently replacing them.
+		if len(account.Filters) == 0 && len(account.Include) > 0 {
+			account.Filters = slices.Clone(c.Filters)
+		}
+		err = merge(account.Include, &account.Filters)
+		if err != nil {
+			return errors.Wrapf(err, "include of account #%d", i+1)
+		}
+	}
+	return nil
+}
+
+// loadConfigFragment parses and validates the included file at path on its
+// own, e.g. to validate the file of each team in CI without credentials.
+// Conditions can only reference the definitions of the file and of the files
+// it includes, and integrations used by actions are assumed to be configured by
+// the including file.
+func loadConfigFragment(path string) (*config, error) {
+	fragment, err := readConfigFragment(path)
+	if err != nil {
+		return nil, err
+	}
+	c := config{
+		Include:     fragment.Include,
+		Definitions: fragment.Definitions,
+		Filters:     fragment.Filters,
+		dir:         filepath.Dir(path),
+		fragment:    true,
+	}
+
+	err = includeConfigFiles(&c, path)
+	if err != nil {
+		return nil, err
+	}
+	err = compileDefinitions(c.Definitions)
+	if err != nil {
+		return nil, err
+	}
+	err = compileFilters(&c, c.Filters)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// readConfigFragment reads the included file, where relative paths of filter
+// tests are resolved against the directory of the file.
+func readConfigFragment(path string) (*configFragment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read included file")
+	}
+
+	// Keys other than those of configFragment are rejected, e.g. credentials.
+	var fragment configFragment
+	err = decodeConfigFile(path, data, &fragment)
+	if err != nil {
+		return nil, err
+	}
+	for name, d := range fragment.Definitions {
+		d.source = path
+		fragment.Definitions[name] = d
+	}
+
+	dir := filepath.Dir(path)
+	for i := range fragment.Filters {
+		fragment.Filters[i].source = path
+		for j := range fragment.Filters[i].Tests {
+			test := &fragment.Filters[i].Tests[j]
+			if test.File != "" && !filepath.IsAbs(test.File) {
+				test.File = filepath.Join(dir, test.File)
+			}
+		}
+	}
+	return &fragment, nil
+}
+
+// globConfigFiles returns the files matching the pattern sorted by name, where
+// directories are expanded to the YAML files in them, e.g. "filters.d".
+func globConfigFiles(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	// Only patterns with wildcards may match nothing, e.g. an empty directory.
+	if len(matches) == 0 && !strings.ContainsAny(pattern, `*?[\`) {
+		_, err = os.Stat(pattern)
+		return nil, err
+	}
+
+	var files []string
+	for _, match := range matches {
+		fi, err := os.Stat(match)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, match)
+			continue
+		}
+
+		entries, err := os.ReadDir(match)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if !entry.IsDir() && (ext == ".yml" || ext == ".yaml") {
+				files = append(files, filepath.Join(match, entry.Name()))
+			}
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigAccountIncludes(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"gmail-blade.yml": `
+filters:
+  - name: "Shared"
+    condition: 'true'
+    actions: [star]
+accounts:
+  - name: "joe"
+    credentials:
+      username: "joe@acme.com"
+    include: ["joe.yml"]
+  - name: "jane"
+    credentials:
+      username: "jane@acme.com"
+    filters:
+      - name: "Jane only"
+        condition: 'true'
+        actions: [star]
+    include: ["jane.yml"]
+  - name: "bob"
+    credentials:
+      username: "bob@acme.com"
+`,
+		"joe.yml": `
+filters:
+  - name: "Joe included"
+    condition: 'true'
+    actions: [star]
+`,
+		"jane.yml": `
+filters:
+  - name: "Jane included"
+    condition: 'true'
+    actions: [star]
+`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config, err := loadConfig(filepath.Join(dir, "gmail-blade.yml"), secretResolver{disabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string, len(config.Accounts))
+	for _, account := range config.Accounts {
+		for _, f := range account.Filters {
+			got[account.Name] = append(got[account.Name], f.Name)
+		}
+	}
+	want := map[string][]string{
+		// Included filters are added to the top-level ones the account falls
+		// back to.
+		"joe":  {"Shared", "Joe included"},
+		"jane": {"Jane only", "Jane included"},
+		"bob":  {"Shared"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got filters %q, want %q", got, want)
+	}
+}
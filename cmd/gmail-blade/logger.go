@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"slices"
 
 	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
 )
 
 // Logger defines the interface for logging operations.
@@ -45,6 +47,19 @@ func newSlackLogger(underlying Logger, webhookURL string, sendLogLevel log.Level
 	}
 }
 
+// withSlackLogger wraps the logger with a slackLogger when the config sends
+// logs to Slack.
+func withSlackLogger(logger Logger, config *config) (Logger, error) {
+	if config.Slack.SendLogLevel == "" {
+		return logger, nil
+	}
+	sendLevel, err := log.ParseLevel(config.Slack.SendLogLevel)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid slack.send_log_level %q", config.Slack.SendLogLevel)
+	}
+	return newSlackLogger(logger, config.Slack.WebhookURL, sendLevel), nil
+}
+
 func (s *slackLogger) Debug(msg interface{}, keyvals ...interface{}) {
 	s.underlying.Debug(msg, keyvals...)
 	if s.sendLogLevel <= log.DebugLevel {
@@ -128,3 +143,35 @@ func (s *slackLogger) sendToSlack(logLevel log.Level, level, msg string, keyvals
 		s.underlying.Error("Slack webhook returned non-200 status", "status", resp.StatusCode)
 	}
 }
+
+// fieldsLogger wraps a Logger and prepends the same key-value pairs to every
+// message.
+type fieldsLogger struct {
+	Logger
+	keyvals []interface{}
+}
+
+// withFields returns a Logger that prepends the given key-value pairs to every
+// message of the underlying logger.
+func withFields(underlying Logger, keyvals ...interface{}) Logger {
+	return &fieldsLogger{
+		Logger:  underlying,
+		keyvals: keyvals,
+	}
+}
+
+func (l *fieldsLogger) Debug(msg interface{}, keyvals ...interface{}) {
+	l.Logger.Debug(msg, append(slices.Clip(l.keyvals), keyvals...)...)
+}
+
+func (l *fieldsLogger) Info(msg interface{}, keyvals ...interface{}) {
+	l.Logger.Info(msg, append(slices.Clip(l.keyvals), keyvals...)...)
+}
+
+func (l *fieldsLogger) Warn(msg interface{}, keyvals ...interface{}) {
+	l.Logger.Warn(msg, append(slices.Clip(l.keyvals), keyvals...)...)
+}
+
+func (l *fieldsLogger) Error(msg interface{}, keyvals ...interface{}) {
+	l.Logger.Error(msg, append(slices.Clip(l.keyvals), keyvals...)...)
+}
@@ -9,6 +9,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -55,6 +56,14 @@ func main() {
 						Name:  "uids",
 						Usage: "Comma-separated list of UIDs to process (if not specified, processes all unread messages)",
 					},
+					&cli.StringFlag{
+						Name:  "account",
+						Usage: "Only process the account with the given name (if not specified, processes all configured accounts)",
+					},
+					&cli.StringFlag{
+						Name:  "mailbox",
+						Usage: "Only process the given mailbox (if not specified, processes all configured mailboxes)",
+					},
 				),
 				Action: func(c *cli.Context) error {
 					if c.Bool("errors-only") && c.Bool("debug") {
@@ -73,12 +82,9 @@ func main() {
 						return errors.Wrap(err, "parse config")
 					}
 
-					if config.Slack.SendLogLevel != "" {
-						sendLevel, err := log.ParseLevel(config.Slack.SendLogLevel)
-						if err != nil {
-							return errors.Wrapf(err, "invalid slack.send_log_level %q", config.Slack.SendLogLevel)
-						}
-						logger = newSlackLogger(logger, config.Slack.WebhookURL, sendLevel)
+					logger, err = withSlackLogger(logger, config)
+					if err != nil {
+						return err
 					}
 
 					var targetUIDs map[imap.UID]struct{}
@@ -92,30 +98,391 @@ func main() {
 							return errors.New("UIDs cannot be empty")
 						}
 					}
-					cache := newCloudflareKVCache(config.Cache.CloudflareKV)
-					if targetedRun {
-						cache = nil
+					accounts, err := selectAccounts(config, c.String("account"))
+					if err != nil {
+						return err
+					}
+					if targetedRun && len(accounts) > 1 {
+						return errors.New("--account must be specified to process UIDs when multiple accounts are configured")
 					}
-					var highestUID imap.UID
-					if cache != nil {
-						highestUID, err = cache.highestUID(
+					for _, account := range accounts {
+						if c.IsSet("mailbox") {
+							if !slices.Contains(account.Mailboxes, c.String("mailbox")) {
+								return errors.Errorf("mailbox %q is not in the configured mailboxes of account %q", c.String("mailbox"), account.Name)
+							}
+							account.Mailboxes = []string{c.String("mailbox")}
+						}
+						cache := newCloudflareKVCache(account.Cache.CloudflareKV)
+						if targetedRun {
+							cache = nil
+						}
+						checkpoint := newCheckpoint()
+						if cache != nil {
+							checkpoint, err = cache.checkpoint(
+								c.Context,
+								account.Credentials.Username,
+							)
+							if err != nil {
+								return errors.Wrapf(err, "get cached checkpoint for account %q", account.Name)
+							}
+						}
+
+						err = runOnce(
+							accountLogger(logger, config, account),
 							c.Context,
-							config.Credentials.Username,
+							c.Bool("dry-run"),
+							config,
+							account,
+							cache,
+							checkpoint,
+							nil,
+							targetUIDs,
 						)
 						if err != nil {
-							return errors.Wrap(err, "get highest cached UID")
+							return errors.Wrapf(err, "account %q", account.Name)
+						}
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "backfill",
+				Usage: "Run filters over historical messages",
+				Flags: append(
+					commonFlags,
+					&cli.StringFlag{
+						Name:  "account",
+						Usage: "The name of the account to process (required when multiple accounts are configured)",
+					},
+					&cli.StringFlag{
+						Name:  "mailbox",
+						Usage: "The mailbox to process (if not specified, processes the first configured mailbox)",
+					},
+					&cli.StringFlag{
+						Name:  "since",
+						Usage: "Only process messages on or after the date, e.g. 2025-01-31",
+					},
+					&cli.StringFlag{
+						Name:  "before",
+						Usage: "Only process messages before the date, e.g. 2026-01-31",
+					},
+					&cli.StringFlag{
+						Name:  "search",
+						Usage: "Only process messages matching the Gmail search query, e.g. \"from:github.com\"",
+					},
+					&cli.BoolFlag{
+						Name:  "include-read",
+						Usage: "Also process read messages",
+					},
+					&cli.StringFlag{
+						Name:  "state-file",
+						Value: "gmail-blade-backfill.json",
+						Usage: "Path to the file that saves the progress to resume after interruption",
+					},
+				),
+				Action: func(c *cli.Context) error {
+					if c.Bool("errors-only") && c.Bool("debug") {
+						return errors.New("cannot use both --errors-only and --debug flags")
+					}
+
+					var logger Logger = log.New(os.Stderr)
+					if c.Bool("debug") {
+						logger.SetLevel(log.DebugLevel)
+					} else if c.Bool("errors-only") {
+						logger.SetLevel(log.ErrorLevel)
+					}
+
+					for _, name := range []string{"since", "before"} {
+						if c.String(name) == "" {
+							continue
+						}
+						if _, err := time.Parse(backfillDateLayout, c.String(name)); err != nil {
+							return errors.Errorf("invalid --%s %q, must be in the format of %s", name, c.String(name), backfillDateLayout)
 						}
 					}
 
-					return runOnce(
-						logger,
-						c.Context,
+					config, err := parseConfig(c.String("config"))
+					if err != nil {
+						return errors.Wrap(err, "parse config")
+					}
+
+					logger, err = withSlackLogger(logger, config)
+					if err != nil {
+						return err
+					}
+
+					accounts, err := selectAccounts(config, c.String("account"))
+					if err != nil {
+						return err
+					}
+					if len(accounts) > 1 {
+						return errors.New("--account must be specified when multiple accounts are configured")
+					}
+					account := accounts[0]
+
+					// Muted threads are still skipped.
+					checkpoint := newCheckpoint()
+					if cache := newCloudflareKVCache(account.Cache.CloudflareKV); cache != nil {
+						checkpoint, err = cache.checkpoint(c.Context, account.Credentials.Username)
+						if err != nil {
+							return errors.Wrapf(err, "get cached checkpoint for account %q", account.Name)
+						}
+					}
+
+					options := backfillOptions{
+						Account:     account.Name,
+						Mailbox:     c.String("mailbox"),
+						Since:       c.String("since"),
+						Before:      c.String("before"),
+						Search:      c.String("search"),
+						IncludeRead: c.Bool("include-read"),
+					}
+					if options.Mailbox == "" {
+						options.Mailbox = account.Mailboxes[0]
+					}
+
+					// Stop between messages on interruption, so that the state file is
+					// accurate to resume from.
+					ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+					defer stop()
+					err = runBackfill(
+						accountLogger(logger, config, account),
+						ctx,
 						c.Bool("dry-run"),
 						config,
-						cache,
-						&highestUID,
-						targetUIDs,
+						account,
+						checkpoint,
+						options,
+						c.String("state-file"),
 					)
+					if err != nil {
+						return errors.Wrapf(err, "account %q", account.Name)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "simulate",
+				Usage:     "Evaluate filters against .eml files, Maildirs or mbox files without connecting to the IMAP server",
+				ArgsUsage: "<path>...",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   "gmail-blade.yml",
+						Usage:   "Path to config file",
+					},
+					&cli.BoolFlag{
+						Name:  "debug",
+						Usage: "Show debug output",
+					},
+					&cli.StringFlag{
+						Name:  "account",
+						Usage: "The name of the account whose filters to evaluate (required when multiple accounts are configured)",
+					},
+					&cli.StringFlag{
+						Name:  "mailbox",
+						Usage: "The mailbox the messages are in (if not specified, uses the first configured mailbox)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return errors.New("at least one path must be specified")
+					}
+
+					var logger Logger = log.New(os.Stderr)
+					if c.Bool("debug") {
+						logger.SetLevel(log.DebugLevel)
+					}
+
+					// Secrets are not needed without connecting to any server, so
+					// that it runs in CI without credentials.
+					config, err := loadConfig(c.String("config"), secretResolver{disabled: true})
+					if err != nil {
+						return errors.Wrap(err, "parse config")
+					}
+					accounts, err := selectAccounts(config, c.String("account"))
+					if err != nil {
+						return err
+					}
+					if len(accounts) > 1 {
+						return errors.New("--account must be specified when multiple accounts are configured")
+					}
+					account := accounts[0]
+
+					mailbox := c.String("mailbox")
+					if mailbox == "" {
+						mailbox = account.Mailboxes[0]
+					} else if !slices.Contains(account.Mailboxes, mailbox) {
+						// Filters of other mailboxes would silently never match.
+						return errors.Errorf("mailbox %q is not in the configured mailboxes of account %q", mailbox, account.Name)
+					}
+					return runSimulate(
+						accountLogger(logger, config, account),
+						c.Context,
+						os.Stdout,
+						config,
+						account,
+						mailbox,
+						c.Args().Slice(),
+					)
+				},
+			},
+			{
+				Name:  "test",
+				Usage: "Run the tests of filters without connecting to the IMAP server",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   "gmail-blade.yml",
+						Usage:   "Path to config file",
+					},
+					&cli.BoolFlag{
+						Name:  "debug",
+						Usage: "Show debug output",
+					},
+					&cli.StringFlag{
+						Name:  "account",
+						Usage: "Only run the tests of the account with the given name (if not specified, runs for all configured accounts)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					var logger Logger = log.New(os.Stderr)
+					if c.Bool("debug") {
+						logger.SetLevel(log.DebugLevel)
+					}
+
+					// Tests run offline as a regression gate in CI, without
+					// credentials.
+					config, err := loadConfig(c.String("config"), secretResolver{disabled: true})
+					if err != nil {
+						return errors.Wrap(err, "parse config")
+					}
+					accounts, err := selectAccounts(config, c.String("account"))
+					if err != nil {
+						return err
+					}
+					total, failed, err := runFilterTests(logger, c.Context, os.Stdout, config, accounts)
+					if err != nil {
+						return err
+					}
+					if failed > 0 {
+						return errors.Errorf("%d of %d tests failed", failed, total)
+					}
+					fmt.Printf("All %d tests passed\n", total)
+					return nil
+				},
+			},
+			{
+				Name:  "validate",
+				Usage: "Validate the config file, and exit with a non-zero status on the first error",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   "gmail-blade.yml",
+						Usage:   "Path to config file",
+					},
+					&cli.BoolFlag{
+						Name:  "check-mailboxes",
+						Usage: "Check that mailboxes and labels exist by connecting to the IMAP servers, which requires the credentials",
+					},
+					&cli.BoolFlag{
+						Name:  "fragment",
+						Usage: "Validate the file as a file included by the config file, e.g. filters.d/team.yml",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					var config *config
+					var err error
+					if c.Bool("fragment") {
+						if c.Bool("check-mailboxes") {
+							return cli.Exit("--check-mailboxes cannot be used together with --fragment", 1)
+						}
+						config, err = loadConfigFragment(c.String("config"))
+					} else {
+						// Secrets are only required to connect to the IMAP servers.
+						config, err = loadConfig(c.String("config"), secretResolver{disabled: !c.Bool("check-mailboxes")})
+					}
+					if err == nil {
+						err = runValidate(os.Stdout, c.String("config"), config, c.Bool("check-mailboxes"))
+					}
+					if err != nil {
+						// Print the error without the stack trace, which is noise to
+						// editors and pre-commit hooks.
+						return cli.Exit(err.Error(), 1)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "explain",
+				Usage: "Show how filters are evaluated against a message without running any actions",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   "gmail-blade.yml",
+						Usage:   "Path to config file",
+					},
+					&cli.BoolFlag{
+						Name:  "debug",
+						Usage: "Show debug output",
+					},
+					&cli.UintFlag{
+						Name:  "uid",
+						Usage: "The UID of the message to fetch from the IMAP server",
+					},
+					&cli.StringFlag{
+						Name:  "file",
+						Usage: "The .eml file, Maildir or mbox file of the messages, instead of --uid",
+					},
+					&cli.StringFlag{
+						Name:  "account",
+						Usage: "The name of the account whose filters to evaluate (required when multiple accounts are configured)",
+					},
+					&cli.StringFlag{
+						Name:  "mailbox",
+						Usage: "The mailbox the message is in (if not specified, uses the first configured mailbox)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.IsSet("uid") == c.IsSet("file") {
+						return errors.New("exactly one of --uid and --file must be specified")
+					}
+
+					var logger Logger = log.New(os.Stderr)
+					if c.Bool("debug") {
+						logger.SetLevel(log.DebugLevel)
+					}
+
+					// Secrets are only needed to fetch the message from the IMAP
+					// server, explaining files works offline.
+					config, err := loadConfig(c.String("config"), secretResolver{disabled: c.IsSet("file")})
+					if err != nil {
+						return errors.Wrap(err, "parse config")
+					}
+					accounts, err := selectAccounts(config, c.String("account"))
+					if err != nil {
+						return err
+					}
+					if len(accounts) > 1 {
+						return errors.New("--account must be specified when multiple accounts are configured")
+					}
+					account := accounts[0]
+
+					mailbox := c.String("mailbox")
+					if mailbox == "" {
+						mailbox = account.Mailboxes[0]
+					} else if !slices.Contains(account.Mailboxes, mailbox) {
+						return errors.Errorf("mailbox %q is not in the configured mailboxes of account %q", mailbox, account.Name)
+					}
+					logger = accountLogger(logger, config, account)
+					if c.IsSet("file") {
+						return runExplainFile(logger, c.Context, os.Stdout, config, account, mailbox, c.String("file"))
+					}
+					return runExplain(logger, c.Context, os.Stdout, config, account, mailbox, imap.UID(c.Uint("uid")))
 				},
 			},
 			{
@@ -139,15 +506,14 @@ func main() {
 						return errors.Wrap(err, "parse config")
 					}
 
-					if config.Slack.SendLogLevel != "" {
-						sendLevel, err := log.ParseLevel(config.Slack.SendLogLevel)
-						if err != nil {
-							return errors.Wrapf(err, "invalid slack.send_log_level %q", config.Slack.SendLogLevel)
-						}
-						logger = newSlackLogger(logger, config.Slack.WebhookURL, sendLevel)
-					}
-
-					return runServer(logger, c.Bool("dry-run"), config)
+					return runServer(logger, c.Bool("dry-run"), c.String("config"), config)
+				},
+			},
+			{
+				Name:  "schema",
+				Usage: "Print the JSON Schema of the config file for editors to autocomplete and validate the config",
+				Action: func(c *cli.Context) error {
+					return writeConfigSchema(os.Stdout)
 				},
 			},
 			{
@@ -163,9 +529,13 @@ func main() {
 						Name:  "debug",
 						Usage: "Show debug output",
 					},
+					&cli.StringFlag{
+						Name:  "account",
+						Usage: "Only list mailboxes of the account with the given name (if not specified, lists for all configured accounts)",
+					},
 				},
 				Action: func(c *cli.Context) error {
-					logger := log.New(os.Stderr)
+					var logger Logger = log.New(os.Stderr)
 					if c.Bool("debug") {
 						logger.SetLevel(log.DebugLevel)
 					}
@@ -174,7 +544,17 @@ func main() {
 					if err != nil {
 						return errors.Wrap(err, "parse config")
 					}
-					return runListMailboxes(logger, config)
+					accounts, err := selectAccounts(config, c.String("account"))
+					if err != nil {
+						return err
+					}
+					for _, account := range accounts {
+						err = runListMailboxes(accountLogger(logger, config, account), account)
+						if err != nil {
+							return errors.Wrapf(err, "account %q", account.Name)
+						}
+					}
+					return nil
 				},
 			},
 		},
@@ -185,12 +565,31 @@ func main() {
 	}
 }
 
-var (
-	labelRegexp             = regexp.MustCompile(`label "([^"]*)"`)
-	moveToRegexp            = regexp.MustCompile(`move to "([^"]*)"`)
-	githubReviewRegexp      = regexp.MustCompile(`(?i)github\s+review`)
-	githubPullRequestRegexp = regexp.MustCompile(`(?i)github\s+pull\s+request`)
-)
+var githubPullRequestRegexp = regexp.MustCompile(`(?i)github\s+pull\s+request`)
+
+// selectAccounts returns the account with the given name, or all accounts when
+// the name is empty.
+func selectAccounts(config *config, name string) ([]*configAccount, error) {
+	var accounts []*configAccount
+	for i := range config.Accounts {
+		if name == "" || config.Accounts[i].Name == name {
+			accounts = append(accounts, &config.Accounts[i])
+		}
+	}
+	if len(accounts) == 0 {
+		return nil, errors.Errorf("account %q is not configured", name)
+	}
+	return accounts, nil
+}
+
+// accountLogger returns a logger that tags every message with the account name
+// when multiple accounts are configured.
+func accountLogger(logger Logger, config *config, account *configAccount) Logger {
+	if len(config.Accounts) <= 1 {
+		return logger
+	}
+	return withFields(logger, "account", account.Name)
+}
 
 // transientErrors is a list of error messages that are considered transient
 // and should be retried with backoff.
@@ -240,47 +639,124 @@ func runOnce(
 	ctx context.Context,
 	dryRun bool,
 	config *config,
+	account *configAccount,
 	cache *cloudflareKVCache,
-	highestUID *imap.UID,
+	checkpoint *checkpoint,
+	gmail *gmailClient,
 	targetUIDs map[imap.UID]struct{},
 ) error {
-	client, closeClient, err := getAuthenticatedClient(config.Credentials, &imapclient.Options{})
+	client, closeClient, err := getAuthenticatedClient(account.IMAP, account.Credentials, &imapclient.Options{})
 	if err != nil {
 		return errors.Wrap(err, "get authenticated IMAP client")
 	}
 	defer closeClient()
 
-	_, err = client.Select(
-		"INBOX",
+	// The gmail client of the caller is reused across runs when given, e.g. by
+	// the polling server, to not log in again on every poll.
+	if !client.Caps().Has(gmailCapability) {
+		gmail = nil
+	} else if gmail == nil {
+		gmail = newGmailClient(account.IMAP, account.Credentials)
+		defer func() { _ = gmail.Close() }()
+	}
+
+	for _, mailbox := range account.Mailboxes {
+		err = processMailbox(logger, ctx, dryRun, config, account, client, gmail, cache, mailbox, checkpoint, targetUIDs)
+		if err != nil {
+			return errors.Wrapf(err, "mailbox %q", mailbox)
+		}
+	}
+	return nil
+}
+
+// newGmailClientIfSupported returns a client for the Gmail IMAP extensions when
+// the server advertises them, and nil otherwise.
+func newGmailClientIfSupported(client *imapclient.Client, account *configAccount) *gmailClient {
+	if !client.Caps().Has(gmailCapability) {
+		return nil
+	}
+	return newGmailClient(account.IMAP, account.Credentials)
+}
+
+// processMailbox processes unread messages, or messages matching the search
+// query of the account, in the mailbox after its highest processed UID using
+// the given authenticated client. The highest processed UID of the mailbox is
+// advanced in the checkpoint as messages are processed. The gmail client is nil
+// when the server does not support the Gmail IMAP extensions.
+func processMailbox(
+	logger Logger,
+	ctx context.Context,
+	dryRun bool,
+	config *config,
+	account *configAccount,
+	client *imapclient.Client,
+	gmail *gmailClient,
+	cache *cloudflareKVCache,
+	mailbox string,
+	checkpoint *checkpoint,
+	targetUIDs map[imap.UID]struct{},
+) error {
+	// Actions like "mark read" need to store flags, which is only allowed when
+	// the mailbox is selected for read-write access.
+	_, err := client.Select(
+		mailbox,
 		&imap.SelectOptions{
-			ReadOnly: true,
+			ReadOnly: dryRun,
 		},
 	).Wait()
 	if err != nil {
-		return errors.Wrap(err, "select INBOX")
+		return errors.Wrap(err, "select mailbox")
 	}
 
-	uidRange := imap.UIDSet{}
-	uidRange.AddRange(*highestUID+1, 0)
-	searchData, err := client.UIDSearch(
-		&imap.SearchCriteria{
-			UID:     []imap.UIDSet{uidRange},
-			NotFlag: []imap.Flag{imap.FlagSeen},
-		},
-		nil,
-	).Wait()
+	highestUID := checkpoint.HighestUIDs[mailbox]
+	var messageUIDs []imap.UID
+	if account.Search != "" {
+		if gmail == nil {
+			return errors.Errorf("search requires an IMAP server with the %s extension", gmailCapability)
+		}
+		messageUIDs, err = gmail.searchRaw(mailbox, highestUID, false, account.Search)
+		if err != nil {
+			return errors.Wrapf(err, "search messages matching %q after highest processed UID", account.Search)
+		}
+	} else {
+		uidRange := imap.UIDSet{}
+		uidRange.AddRange(highestUID+1, 0)
+		searchData, err := client.UIDSearch(
+			&imap.SearchCriteria{
+				UID:     []imap.UIDSet{uidRange},
+				NotFlag: []imap.Flag{imap.FlagSeen},
+			},
+			nil,
+		).Wait()
+		if err != nil {
+			return errors.Wrap(err, "search unread messages after highest processed UID")
+		}
+		// The dynamic range "n:*" matches the highest UID in the mailbox even when
+		// that highest UID is below n: the server resolves "*" to the greatest UID
+		// present, and IMAP ranges are order-independent, so "2431:*" collapses to
+		// "2431:2430" == "2430:2431" and re-matches the last message forever. Drop
+		// anything at or below the watermark to enforce a strict "greater than".
+		messageUIDs = searchData.AllUIDs()
+		messageUIDs = slices.DeleteFunc(messageUIDs, func(uid imap.UID) bool {
+			return uid <= highestUID
+		})
+	}
+
+	// Nothing is new in most polls and IDLE wakeups, which should not cost a
+	// search per filter on the Gmail connection.
+	if len(messageUIDs) == 0 {
+		logger.Debug("No candidate messages found after highest processed UID", "mailbox", mailbox, "highestUID", highestUID, "search", account.Search)
+		return nil
+	}
+
+	// Filters with a search query only match messages found by the query. When
+	// every filter of the mailbox has one, there is no need to fetch any other
+	// messages.
+	searches, err := searchFilters(gmail, account, mailbox, highestUID, account.Search == "")
 	if err != nil {
-		return errors.Wrap(err, "search unread messages after highest processed UID")
-	}
-	// The dynamic range "n:*" matches the highest UID in the mailbox even when
-	// that highest UID is below n: the server resolves "*" to the greatest UID
-	// present, and IMAP ranges are order-independent, so "2431:*" collapses to
-	// "2431:2430" == "2430:2431" and re-matches the last message forever. Drop
-	// anything at or below the watermark to enforce a strict "greater than".
-	messageUIDs := searchData.AllUIDs()
-	messageUIDs = slices.DeleteFunc(messageUIDs, func(uid imap.UID) bool {
-		return uid <= *highestUID
-	})
+		return err
+	}
+	messageUIDs = searches.narrow(messageUIDs)
 
 	for idx := 0; idx < len(messageUIDs); idx += 100 {
 		select {
@@ -291,20 +767,19 @@ func runOnce(
 
 		end := min(idx+100, len(messageUIDs))
 		uidSet := imap.UIDSetNum(messageUIDs[idx:end]...)
-		fetchOptions := &imap.FetchOptions{
-			Envelope: true,
-			Flags:    true,
-			UID:      true,
-			BodySection: []*imap.FetchItemBodySection{
-				{Specifier: imap.PartSpecifierText},
-			},
-		}
-
-		messages, err := client.Fetch(uidSet, fetchOptions).Collect()
+		messages, err := client.Fetch(uidSet, messageFetchOptions()).Collect()
 		if err != nil {
 			return errors.Wrap(err, "fetch messages")
 		}
 
+		var gmailAttrs map[imap.UID]gmailAttributes
+		if gmail != nil {
+			gmailAttrs, err = gmail.fetchAttributes(mailbox, messageUIDs[idx:end])
+			if err != nil {
+				return errors.Wrap(err, "fetch Gmail attributes")
+			}
+		}
+
 		var batchHighestUID imap.UID
 		for _, msg := range messages {
 			select {
@@ -320,11 +795,17 @@ func runOnce(
 				}
 			}
 
-			if slices.Contains(msg.Flags, imap.FlagSeen) {
+			// Messages found by the search query of the account may have been read.
+			if account.Search == "" && slices.Contains(msg.Flags, imap.FlagSeen) {
 				continue
 			}
 
-			err = processMessage(logger, ctx, dryRun, config, client, msg)
+			m, err := newMessage(msg, gmailAttrs[msg.UID])
+			if err != nil {
+				return errors.Wrapf(err, "uid %d", msg.UID)
+			}
+			m.searchMatches = searches.queries(msg.UID)
+			err = processMessage(logger, ctx, dryRun, config, account, client, gmail, cache, checkpoint, mailbox, m)
 			if err != nil {
 				return errors.Wrapf(err, "uid %d", msg.UID)
 			}
@@ -337,209 +818,602 @@ func runOnce(
 		}
 		// Only write to the cache when the batch actually moved the highest UID
 		// forward. Cloudflare's KV free plan caps writes at 1000/day, so skip
-		// no-op puts that would store the same value. The in-memory pointer is
+		// no-op puts that would store the same value. The in-memory map is
 		// always advanced so the next search skips messages already processed.
-		if cache != nil && !dryRun && batchHighestUID > *highestUID {
-			if err := cache.put(ctx, config.Credentials.Username, batchHighestUID); err != nil {
+		if cache != nil && !dryRun && batchHighestUID > highestUID {
+			next := checkpoint.clone()
+			next.HighestUIDs[mailbox] = batchHighestUID
+			if err := cache.put(ctx, account.Credentials.Username, next); err != nil {
 				return errors.Wrapf(err, "cache uid %d", batchHighestUID)
 			}
-			logger.Info("Wrote highest UID to cache", "uid", batchHighestUID)
+			logger.Info("Wrote highest UID to cache", "mailbox", mailbox, "uid", batchHighestUID)
 		}
-		*highestUID = max(*highestUID, batchHighestUID)
+		highestUID = max(highestUID, batchHighestUID)
+		checkpoint.HighestUIDs[mailbox] = highestUID
 	}
 	if len(messageUIDs) == 0 {
-		logger.Debug("No unread messages found after highest processed UID", "highestUID", *highestUID)
+		logger.Debug("No candidate messages found by the search queries of filters", "mailbox", mailbox, "highestUID", highestUID)
 	}
 	return nil
 }
 
 const prefetchGitHubPullRequestKey = "githubPullRequest"
 
-type enver interface {
-	Env() map[string]any
+// evaluation is the result of evaluating filters against a message.
+type evaluation struct {
+	matched      []*configFilter // In the order of the config
+	actions      []configAction  // The actions of matched filters
+	prefetchData map[string]any
+	traces       []filterTrace // One for each filter of the account
 }
 
-func processMessage(logger Logger, ctx context.Context, dryRun bool, config *config, client *imapclient.Client, msg *imapclient.FetchMessageBuffer) error {
-	if slices.Contains(msg.Flags, imap.FlagSeen) {
-		return nil
-	}
-
-	from := make([]string, 0, len(msg.Envelope.From))
-	fromName := make([]string, 0, len(msg.Envelope.From))
-	for _, fromAddr := range msg.Envelope.From {
-		from = append(from, fmt.Sprintf("%s@%s", fromAddr.Mailbox, fromAddr.Host))
-		fromName = append(fromName, fromAddr.Name)
-	}
-
-	cc := make([]string, 0, len(msg.Envelope.Cc))
-	for _, ccAddr := range msg.Envelope.Cc {
-		cc = append(cc, fmt.Sprintf("%s@%s", ccAddr.Mailbox, ccAddr.Host))
-	}
-
-	to := make([]string, 0, len(msg.Envelope.To))
-	for _, toAddr := range msg.Envelope.To {
-		to = append(to, fmt.Sprintf("%s@%s", toAddr.Mailbox, toAddr.Host))
-	}
-
-	replyTo := make([]string, 0, len(msg.Envelope.ReplyTo))
-	for _, replyToAddr := range msg.Envelope.ReplyTo {
-		replyTo = append(replyTo, fmt.Sprintf("%s@%s", replyToAddr.Mailbox, replyToAddr.Host))
-	}
+// filterTrace is how a filter was evaluated against a message.
+type filterTrace struct {
+	filter     *configFilter
+	skipped    string   // The reason the filter was not evaluated, empty if it was
+	prefetches []string // The outcomes of the prefetches of the filter
+	env        conditionEnv
+	output     any
+	err        error
+	matched    bool
+}
 
-	logger.Debug(
-		"Unread message",
-		"uid", msg.UID,
-		"from", from,
-		"fromName", fromName,
-		"subject", msg.Envelope.Subject,
-		"cc", cc,
-		"to", to,
-		"replyTo", replyTo,
-	)
+// evaluate evaluates the filters of the account that apply to the mailbox
+// against the message without running any actions, which is shared by
+// processing messages and simulating filters offline. Prefetches are skipped
+// when offline, as they call external APIs that require secrets.
+func evaluate(logger Logger, ctx context.Context, config *config, account *configAccount, mailbox string, msg *message, offline bool) *evaluation {
+	body := msg.Body
 
-	var body string
-	for _, b := range msg.BodySection {
-		body += string(b.Bytes)
+	result := &evaluation{
+		prefetchData: make(map[string]any),
 	}
+	var haltedBy *configFilter
+	for i := range account.Filters {
+		f := &account.Filters[i]
+		trace := filterTrace{filter: f}
+		if haltedBy != nil {
+			trace.skipped = fmt.Sprintf("halted by filter %q", haltedBy.Name)
+			result.traces = append(result.traces, trace)
+			continue
+		}
+		if len(f.Mailboxes) > 0 && !slices.Contains(f.Mailboxes, mailbox) {
+			trace.skipped = fmt.Sprintf("not applied to mailbox %q", mailbox)
+			result.traces = append(result.traces, trace)
+			continue
+		}
+		if f.Search != "" && !msg.searchMatches[f.Search] {
+			trace.skipped = fmt.Sprintf("not found by search %q", f.Search)
+			result.traces = append(result.traces, trace)
+			continue
+		}
 
-	prefetchData := make(map[string]enver)
-	var actions []string
-	for _, f := range config.Filters {
 		for _, prefetch := range f.Prefetches {
-			if githubPullRequestRegexp.MatchString(prefetch) &&
-				githubPullRequestURLRegex.MatchString(body) &&
-				prefetchData[prefetchGitHubPullRequestKey] == nil {
+			if !githubPullRequestRegexp.MatchString(prefetch) {
+				continue
+			}
+			switch {
+			case offline:
+				trace.prefetches = append(trace.prefetches, prefetch+": skipped offline")
+			case !githubPullRequestURLRegex.MatchString(body):
+				trace.prefetches = append(trace.prefetches, prefetch+": skipped as the body has no pull request URL")
+			case result.prefetchData[prefetchGitHubPullRequestKey] != nil:
+				trace.prefetches = append(trace.prefetches, prefetch+": reused")
+			default:
 				prData, err := executePrefetchGitHubPullRequest(logger, ctx, config.GitHub, body)
 				if err != nil {
 					logger.Error("Failed to execute GitHub pull request prefetch", "error", err)
+					trace.prefetches = append(trace.prefetches, prefetch+": failed: "+err.Error())
 					continue
 				}
-				prefetchData[prefetchGitHubPullRequestKey] = prData
+				result.prefetchData[prefetchGitHubPullRequestKey] = prData
+				trace.prefetches = append(trace.prefetches, prefetch+": ran")
 			}
 		}
 
-		env := map[string]any{
-			"message": map[string]any{
-				"from":     from,
-				"fromName": fromName,
-				"subject":  msg.Envelope.Subject,
-				"cc":       cc,
-				"to":       to,
-				"replyTo":  replyTo,
-				"body":     body,
-			},
-		}
-		for key, value := range prefetchData {
-			env[key] = value.Env()
+		trace.env = conditionEnv{
+			Message: msg.Env(),
 		}
+		trace.env.GitHubPullRequest, _ = result.prefetchData[prefetchGitHubPullRequestKey].(*githubPullRequest)
 
-		result, err := expr.Run(f.CompiledCondition, env)
-		if err != nil {
-			logger.Error("Failed to run expression", "error", err)
+		trace.output, trace.err = expr.Run(f.CompiledCondition, trace.env)
+		if trace.err != nil {
+			logger.Error("Failed to run expression", "error", trace.err)
 		}
-		if fmt.Sprintf("%v", result) == "true" {
-			actions = append(actions, f.Actions...)
+		// Conditions are compiled to return booleans.
+		trace.matched, _ = trace.output.(bool)
+		result.traces = append(result.traces, trace)
+		if trace.matched {
+			result.matched = append(result.matched, f)
+			result.actions = append(result.actions, f.Actions...)
 			if f.HaltOnMatch {
 				logger.Debug("Halt on match", "uid", msg.UID, "filter", f.Name)
-				break
+				haltedBy = f
 			}
 		}
 	}
+	// Flags and labels can only be changed while the message is in the mailbox.
+	result.actions = orderActions(result.actions)
+	return result
+}
+
+// processMessage runs the actions of filters that match the message. Callers
+// are responsible for skipping messages that should not be processed, e.g. read
+// ones.
+func processMessage(logger Logger, ctx context.Context, dryRun bool, config *config, account *configAccount, client *imapclient.Client, gmail *gmailClient, cache *cloudflareKVCache, checkpoint *checkpoint, mailbox string, msg *message) error {
+	logger.Debug(
+		"Candidate message",
+		"mailbox", mailbox,
+		"uid", msg.UID,
+		"from", msg.From,
+		"fromName", msg.FromName,
+		"subject", msg.Subject,
+		"cc", msg.Cc,
+		"to", msg.To,
+		"replyTo", msg.ReplyTo,
+		"labels", msg.Labels,
+		"threadId", msg.ThreadID,
+	)
+
+	// Only Gmail messages have thread IDs, so the Gmail client is available.
+	// Messages of muted threads in other mailboxes, e.g. labels, are not in the
+	// inbox to be archived from, and are still filtered.
+	if msg.ThreadID != "" && strings.EqualFold(mailbox, "INBOX") && slices.Contains(checkpoint.MutedThreads, msg.ThreadID) {
+		logger.Info(
+			"Archiving message of muted thread",
+			"uid", msg.UID,
+			"subject", msg.Subject,
+			"threadId", msg.ThreadID,
+			"dryRun", dryRun,
+		)
+		if dryRun {
+			return nil
+		}
+		err := gmail.storeLabels(mailbox, []imap.UID{msg.UID}, false, `\Inbox`)
+		if err != nil {
+			return errors.Wrap(err, "archive email of muted thread")
+		}
+		return nil
+	}
+
+	result := evaluate(logger, ctx, config, account, mailbox, msg, false)
+	actions := result.actions
 
 	if len(actions) == 0 {
 		logger.Debug(
 			"No actions matched",
 			"uid", msg.UID,
-			"subject", msg.Envelope.Subject,
+			"subject", msg.Subject,
 		)
 		return nil
 	}
 
+	actionNames := make([]string, len(actions))
+	for i, action := range actions {
+		actionNames[i] = action.String()
+	}
 	logger.Info(
 		"Actions matched",
 		"uid", msg.UID,
-		"subject", msg.Envelope.Subject,
-		"actions", strings.Join(actions, ", "),
+		"subject", msg.Subject,
+		"actions", strings.Join(actionNames, ", "),
 		"dryRun", dryRun,
 	)
 	if dryRun {
 		return nil
 	}
 
+	// Backfills and targeted runs do not write the cached checkpoint, so muted
+	// threads would be silently forgotten. This is checked before running any
+	// action to not leave the message half processed.
+	if cache == nil && account.Cache.CloudflareKV.enabled() &&
+		slices.ContainsFunc(actions, func(action configAction) bool { return action.Type == actionMuteThread }) {
+		return errors.Errorf("%s action cannot be persisted to the cache by backfills and targeted runs, use %s instead", actionMuteThread, actionArchiveThread)
+	}
+
 	for _, action := range actions {
-		if action == "delete" {
-			uidSet := imap.UIDSetNum()
-			uidSet.AddNum(msg.UID)
-			_, err := client.Move(uidSet, "[Gmail]/Trash").Wait()
+		uidSet := imap.UIDSetNum(msg.UID)
+		switch action.Type {
+		case actionDelete:
+			_, err := client.Move(uidSet, account.IMAP.TrashMailbox).Wait()
 			if err != nil {
 				return errors.Wrapf(err, "move email to trash")
 			}
-		} else if strings.HasPrefix(action, "label ") {
-			match := labelRegexp.FindStringSubmatch(action)
-			if len(match) < 2 {
-				return errors.Errorf("invalid label action format %q", action)
+		case actionLabel:
+			if gmail != nil {
+				err := gmail.storeLabels(mailbox, []imap.UID{msg.UID}, true, action.Name)
+				if err != nil {
+					return errors.Wrapf(err, "add label %q", action.Name)
+				}
+				continue
 			}
-			labelName := match[1]
 
-			uidSet := imap.UIDSetNum()
-			uidSet.AddNum(msg.UID)
-			_, err := client.Copy(uidSet, labelName).Wait()
+			// Copying a message to a mailbox is how labels are added without the
+			// Gmail IMAP extensions.
+			_, err := client.Copy(uidSet, action.Name).Wait()
 			if err != nil {
-				return errors.Wrapf(err, "copy email to label %q", labelName)
+				return errors.Wrapf(err, "copy email to label %q", action.Name)
 			}
-		} else if strings.HasPrefix(action, "move to ") {
-			match := moveToRegexp.FindStringSubmatch(action)
-			if len(match) < 2 {
-				return errors.Errorf("invalid move to action format %q", action)
+		case actionUnlabel:
+			if gmail == nil {
+				return errors.Errorf("unlabel action requires an IMAP server with the %s extension", gmailCapability)
+			}
+			err := gmail.storeLabels(mailbox, []imap.UID{msg.UID}, false, action.Name)
+			if err != nil {
+				return errors.Wrapf(err, "remove label %q", action.Name)
+			}
+		case actionMoveTo:
+			_, err := client.Move(uidSet, action.Mailbox).Wait()
+			if err != nil {
+				return errors.Wrapf(err, "move email to mailbox %q", action.Mailbox)
+			}
+		case actionArchive:
+			if gmail != nil {
+				err := gmail.storeLabels(mailbox, []imap.UID{msg.UID}, false, `\Inbox`)
+				if err != nil {
+					return errors.Wrap(err, "archive email")
+				}
+				continue
+			}
+
+			_, err := client.Move(uidSet, account.IMAP.ArchiveMailbox).Wait()
+			if err != nil {
+				return errors.Wrap(err, "move email to archive")
+			}
+		case actionArchiveThread, actionMuteThread:
+			if gmail == nil {
+				return errors.Errorf("%s action requires an IMAP server with the %s extension", action.Type, gmailCapability)
+			}
+
+			if action.Type == actionMuteThread && checkpoint.muteThread(msg.ThreadID) {
+				if cache == nil {
+					logger.Warn("Muted thread is not persisted without a cache", "uid", msg.UID, "threadId", msg.ThreadID)
+				} else if err := cache.put(ctx, account.Credentials.Username, checkpoint); err != nil {
+					return errors.Wrap(err, "cache muted thread")
+				}
+			}
+
+			// Search in the archive mailbox ("All Mail") as it has every message of
+			// the thread, regardless of the labels.
+			uids, err := gmail.searchThread(account.IMAP.ArchiveMailbox, msg.ThreadID)
+			if err != nil {
+				return errors.Wrap(err, "search messages of thread")
+			}
+			err = gmail.storeLabels(account.IMAP.ArchiveMailbox, uids, false, `\Inbox`)
+			if err != nil {
+				return errors.Wrap(err, "archive thread")
+			}
+		case actionMarkRead, actionMarkUnread, actionStar, actionUnstar:
+			op := imap.StoreFlagsAdd
+			if action.Type == actionMarkUnread || action.Type == actionUnstar {
+				op = imap.StoreFlagsDel
+			}
+			flag := imap.FlagSeen
+			if action.Type == actionStar || action.Type == actionUnstar {
+				flag = imap.FlagFlagged
 			}
-			mailboxName := match[1]
 
-			uidSet := imap.UIDSetNum()
-			uidSet.AddNum(msg.UID)
-			_, err := client.Move(uidSet, mailboxName).Wait()
+			err := client.Store(
+				uidSet,
+				&imap.StoreFlags{
+					Op:     op,
+					Silent: true,
+					Flags:  []imap.Flag{flag},
+				},
+				nil,
+			).Close()
+			if err != nil {
+				return errors.Wrapf(err, "store flag %q", flag)
+			}
+		case actionMarkImportant, actionNotImportant:
+			if gmail == nil {
+				return errors.Errorf("%s action requires an IMAP server with the %s extension", action.Type, gmailCapability)
+			}
+			err := gmail.storeLabels(mailbox, []imap.UID{msg.UID}, action.Type == actionMarkImportant, `\Important`)
+			if err != nil {
+				return errors.Wrap(err, "update important label")
+			}
+		case actionSaveAttachmentsTo:
+			err := msg.walkAttachmentContents(func(filename, mimeType string, content []byte) error {
+				if filename == "" {
+					filename = "attachment"
+				}
+				dst, err := renderAttachmentPath(action.pathTemplate, action.dir, newAttachmentPathData(mailbox, msg, filename))
+				if err != nil {
+					return errors.Wrapf(err, "render path of attachment %q", filename)
+				}
+				dst, err = saveAttachment(ctx, config.Storage, dst, content, mimeType)
+				if err != nil {
+					return errors.Wrapf(err, "save attachment %q to %q", filename, dst)
+				}
+				logger.Info("Saved attachment", "uid", msg.UID, "filename", filename, "path", dst)
+				return nil
+			})
 			if err != nil {
-				return errors.Wrapf(err, "move email to mailbox %q", mailboxName)
+				return errors.Wrap(err, "save attachments")
 			}
-		} else if config.GitHub.Approval.Enabled && githubReviewRegexp.MatchString(action) {
-			err := processGitHubReview(logger, ctx, config.GitHub, msg.UID, prefetchData)
+		case actionGitHubReview:
+			err := processGitHubReview(logger, ctx, config.GitHub, msg.UID, result.prefetchData)
 			if err != nil {
 				return errors.Wrap(err, "process GitHub review action")
 			}
-		} else {
-			logger.Warn("Unknown action", "action", action)
 		}
 	}
 	return nil
 }
 
-func runServer(logger Logger, dryRun bool, config *config) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// errIdleUnsupported is returned by runIdle when the IMAP server does not
+// support the IDLE extension.
+var errIdleUnsupported = errors.New("IMAP server does not support IDLE")
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-
-	go func() {
-		<-sigChan
-		logger.Debug("Received SIGTERM, shutting down")
-		cancel()
-	}()
-	logger.Info("Server started (press Ctrl+C to stop)")
-
-	cache := newCloudflareKVCache(config.Cache.CloudflareKV)
-	var highestUID imap.UID
-	if cache != nil {
-		var err error
-		highestUID, err = cache.highestUID(ctx, config.Credentials.Username)
+// idleRefreshInterval is how long runIdle waits in a single IDLE command. RFC
+// 2177 asks clients to re-issue IDLE at least every 29 minutes, and Gmail drops
+// connections idling for longer.
+const idleRefreshInterval = 25 * time.Minute
+
+// runIdle keeps a single authenticated connection open and processes the
+// mailboxes every time the server pushes an EXISTS or EXPUNGE update during
+// IDLE. Only the first mailbox can be watched with IDLE, any other mailboxes are
+// also processed every server sleep interval. It only returns when the
+// connection fails or the context is done.
+func runIdle(
+	logger Logger,
+	ctx context.Context,
+	dryRun bool,
+	config *config,
+	account *configAccount,
+	cache *cloudflareKVCache,
+	checkpoint *checkpoint,
+) error {
+	// The handlers run on the client's reader goroutine and must not block, so
+	// updates are coalesced into at most one pending notification.
+	updates := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case updates <- struct{}{}:
+		default:
+		}
+	}
+	client, closeClient, err := getAuthenticatedClient(
+		account.IMAP,
+		account.Credentials,
+		&imapclient.Options{
+			UnilateralDataHandler: &imapclient.UnilateralDataHandler{
+				Expunge: func(uint32) { notify() },
+				Mailbox: func(data *imapclient.UnilateralDataMailbox) {
+					if data.NumMessages != nil {
+						notify()
+					}
+				},
+			},
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "get authenticated IMAP client")
+	}
+	defer closeClient()
+
+	if !client.Caps().Has(imap.CapIdle) {
+		return errIdleUnsupported
+	}
+
+	gmail := newGmailClientIfSupported(client, account)
+	defer func() { _ = gmail.Close() }()
+
+	idleMailbox := account.Mailboxes[0]
+	var pollInterval <-chan time.Time
+	if len(account.Mailboxes) > 1 {
+		sleepInterval, _ := time.ParseDuration(config.Server.SleepInterval)
+		ticker := time.NewTicker(sleepInterval)
+		defer ticker.Stop()
+		pollInterval = ticker.C
+	}
+	for {
+		for _, mailbox := range account.Mailboxes {
+			err = processMailbox(logger, ctx, dryRun, config, account, client, gmail, cache, mailbox, checkpoint, nil)
+			if err != nil {
+				return errors.Wrapf(err, "mailbox %q", mailbox)
+			}
+		}
+		if client.Mailbox().Name != idleMailbox {
+			_, err = client.Select(idleMailbox, &imap.SelectOptions{ReadOnly: true}).Wait()
+			if err != nil {
+				return errors.Wrapf(err, "select mailbox %q", idleMailbox)
+			}
+		}
+
+		idleCmd, err := client.Idle()
 		if err != nil {
-			return errors.Wrap(err, "get highest cached UID")
+			return errors.Wrap(err, "start IDLE")
+		}
+		idleDone := make(chan error, 1)
+		go func() { idleDone <- idleCmd.Wait() }()
+		idleRefresh := time.NewTimer(idleRefreshInterval)
+
+		logger.Debug("Waiting for mailbox updates", "mailbox", idleMailbox)
+		select {
+		case <-ctx.Done():
+		case <-updates:
+		case <-pollInterval:
+		case <-idleRefresh.C:
+			logger.Debug("Re-issuing IDLE before the server times it out", "mailbox", idleMailbox)
+		case err = <-idleDone:
+			// IDLE only completes on its own when the connection is gone.
+			if err == nil {
+				err = errors.New("unexpected EOF")
+			}
+			return errors.Wrap(err, "IDLE")
+		}
+		idleRefresh.Stop()
+
+		if err = idleCmd.Close(); err != nil {
+			return errors.Wrap(err, "stop IDLE")
+		}
+		if err = <-idleDone; err != nil {
+			return errors.Wrap(err, "wait for IDLE to stop")
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// runServer processes messages of all accounts until SIGTERM or interrupt. On
+// SIGHUP, the config file at configPath is loaded again, including secrets, and
+// the accounts are restarted with the new config. The current config is kept
+// when the new one fails to load.
+func runServer(logger Logger, dryRun bool, configPath string, config *config) error {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+
+	// Checkpoints of accounts without a cache only live in memory, and are kept
+	// across reloads by the account name.
+	checkpoints := make(map[string]*checkpoint)
+	serverLogger, err := withSlackLogger(logger, config)
+	if err != nil {
+		return err
+	}
+	// Errors of serving accounts, e.g. reading checkpoints from the cache, fail
+	// the server on startup, but are retried after a reload so that a transient
+	// error does not stop the long-running server.
+	retryErrors := false
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		// The config and logger are only replaced once this is done.
+		go func() {
+			sleepInterval, _ := time.ParseDuration(config.Server.SleepInterval)
+			for {
+				err := serveAccounts(serverLogger, ctx, dryRun, config, checkpoints)
+				if err == nil || !retryErrors || ctx.Err() != nil {
+					done <- err
+					return
+				}
+				serverLogger.Error("Failed to serve accounts, retrying", "error", err, "interval", sleepInterval)
+				select {
+				case <-ctx.Done():
+					done <- nil
+					return
+				case <-time.After(sleepInterval):
+				}
+			}
+		}()
+
+		reloaded := false
+		for !reloaded {
+			select {
+			case err = <-done:
+				cancel()
+				return err
+			case sig := <-sigChan:
+				if sig != syscall.SIGHUP {
+					serverLogger.Debug("Received SIGTERM, shutting down")
+					cancel()
+					return <-done
+				}
+
+				serverLogger.Info("Received SIGHUP, reloading config", "path", configPath)
+				// There is no terminal to prompt for empty secrets while running.
+				newConfig, err := loadConfig(configPath, secretResolver{nonInteractive: true})
+				var newLogger Logger
+				if err == nil {
+					newLogger, err = withSlackLogger(logger, newConfig)
+				}
+				if err != nil {
+					serverLogger.Error("Failed to reload config, keeping the current one", "error", err)
+					continue
+				}
+
+				cancel()
+				err = <-done
+				if err != nil {
+					return err
+				}
+				config, serverLogger = newConfig, newLogger
+				reloaded = true
+				retryErrors = true
+			}
+		}
+	}
+}
+
+// serveAccounts runs the server of each account until the context is done.
+func serveAccounts(logger Logger, ctx context.Context, dryRun bool, config *config, checkpoints map[string]*checkpoint) error {
+	// Load all checkpoints before starting, so that a misconfigured cache fails
+	// fast instead of leaving some accounts running.
+	caches := make([]*cloudflareKVCache, len(config.Accounts))
+	accountCheckpoints := make([]*checkpoint, len(config.Accounts))
+	for i := range config.Accounts {
+		account := &config.Accounts[i]
+		caches[i] = newCloudflareKVCache(account.Cache.CloudflareKV)
+		if caches[i] != nil {
+			var err error
+			accountCheckpoints[i], err = caches[i].checkpoint(ctx, account.Credentials.Username)
+			if err != nil {
+				return errors.Wrapf(err, "get cached checkpoint for account %q", account.Name)
+			}
+			continue
 		}
+
+		if checkpoints[account.Name] == nil {
+			checkpoints[account.Name] = newCheckpoint()
+		}
+		accountCheckpoints[i] = checkpoints[account.Name]
+	}
+	logger.Info("Server started (press Ctrl+C to stop)", "idle", config.Server.Idle, "accounts", len(config.Accounts))
+
+	var wg sync.WaitGroup
+	for i := range config.Accounts {
+		account := &config.Accounts[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runAccountServer(accountLogger(logger, config, account), ctx, dryRun, config, account, caches[i], accountCheckpoints[i])
+		}()
 	}
+	wg.Wait()
+
+	logger.Info("Server stopped")
+	return nil
+}
+
+// runAccountServer processes messages of the account until the context is done,
+// backing off independently of other accounts on transient errors.
+func runAccountServer(
+	logger Logger,
+	ctx context.Context,
+	dryRun bool,
+	config *config,
+	account *configAccount,
+	cache *cloudflareKVCache,
+	checkpoint *checkpoint,
+) {
 	configuredSleepInternal, _ := time.ParseDuration(config.Server.SleepInterval)
+	useIdle := config.Server.Idle
 	backoffTimes := 0
-serverRoutine:
+	// The connection for the Gmail IMAP extensions is only opened on first use,
+	// and kept across polls.
+	gmail := newGmailClient(account.IMAP, account.Credentials)
+	defer func() { _ = gmail.Close() }()
 	for {
-		err := runOnce(logger, ctx, dryRun, config, cache, &highestUID, nil)
+		var err error
+		if useIdle {
+			startedAt := time.Now()
+			err = runIdle(logger, ctx, dryRun, config, account, cache, checkpoint)
+			if errors.Is(err, errIdleUnsupported) {
+				logger.Warn("IMAP server does not support IDLE, falling back to polling")
+				useIdle = false
+				continue
+			}
+			// A long-lived IDLE session that eventually drops is expected, and
+			// should not count towards consecutive failures.
+			if time.Since(startedAt) > time.Minute {
+				backoffTimes = 0
+			}
+		} else {
+			err = runOnce(logger, ctx, dryRun, config, account, cache, checkpoint, gmail, nil)
+		}
 		if err != nil && !errors.Is(err, context.Canceled) {
 			if isTransientError(err) {
 				backoffTimes++
@@ -563,17 +1437,14 @@ serverRoutine:
 		}
 		select {
 		case <-ctx.Done():
-			break serverRoutine
+			return
 		case <-time.After(sleepInterval):
 		}
 	}
-
-	logger.Info("Server stopped")
-	return nil
 }
 
-func runListMailboxes(logger Logger, config *config) error {
-	client, closeClient, err := getAuthenticatedClient(config.Credentials, &imapclient.Options{})
+func runListMailboxes(logger Logger, account *configAccount) error {
+	client, closeClient, err := getAuthenticatedClient(account.IMAP, account.Credentials, &imapclient.Options{})
 	if err != nil {
 		return errors.Wrap(err, "get authenticated IMAP client")
 	}
@@ -591,13 +1462,41 @@ func runListMailboxes(logger Logger, config *config) error {
 	return nil
 }
 
-func getAuthenticatedClient(credentials configCredentials, options *imapclient.Options) (_ *imapclient.Client, close func(), _ error) {
-	client, err := imapclient.DialTLS("imap.gmail.com:993", options)
+func getAuthenticatedClient(endpoint configIMAP, credentials configCredentials, options *imapclient.Options) (_ *imapclient.Client, close func(), _ error) {
+	var client *imapclient.Client
+	var err error
+	switch endpoint.Security {
+	case imapSecurityPlain:
+		client, err = imapclient.DialInsecure(endpoint.address(), options)
+	default:
+		options.TLSConfig, err = endpoint.tlsConfig()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "build TLS config")
+		}
+		if endpoint.Security == imapSecurityStartTLS {
+			client, err = imapclient.DialStartTLS(endpoint.address(), options)
+		} else {
+			client, err = imapclient.DialTLS(endpoint.address(), options)
+		}
+	}
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "dial IMAP server")
 	}
 
-	if err = client.Login(credentials.Username, credentials.Password).Wait(); err != nil {
+	if credentials.OAuth2.tokenSource != nil {
+		// Tokens are refreshed transparently once expired, so every new connection
+		// of a long-running server authenticates with a valid access token.
+		token, err := credentials.OAuth2.tokenSource.Token()
+		if err != nil {
+			_ = client.Close()
+			return nil, nil, errors.Wrap(err, "get OAuth2 access token")
+		}
+		err = client.Authenticate(newOAuth2SASLClient(client.Caps(), credentials.Username, token.AccessToken))
+		if err != nil {
+			_ = client.Close()
+			return nil, nil, errors.Wrap(err, "authenticate to IMAP server")
+		}
+	} else if err = client.Login(credentials.Username, credentials.Password).Wait(); err != nil {
 		_ = client.Close()
 		return nil, nil, errors.Wrap(err, "login to IMAP server")
 	}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/log"
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
+)
+
+// newTestIMAPServer starts a go-imap memory server without the Gmail IMAP
+// extensions, with a user that has the mailboxes in addition to INBOX.
+func newTestIMAPServer(t *testing.T, username, password string, mailboxes ...string) (*imapmemserver.User, configIMAP) {
+	t.Helper()
+
+	user := imapmemserver.NewUser(username, password)
+	for _, mailbox := range append([]string{"INBOX"}, mailboxes...) {
+		if err := user.Create(mailbox, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	memServer := imapmemserver.New()
+	memServer.AddUser(user)
+
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(*imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return memServer.NewSession(), nil, nil
+		},
+		Caps:         imap.CapSet{imap.CapIMAP4rev1: {}, imap.CapIMAP4rev2: {}},
+		InsecureAuth: true,
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	addr := listener.Addr().(*net.TCPAddr)
+	return user, configIMAP{Host: "127.0.0.1", Port: addr.Port, Security: imapSecurityPlain}
+}
+
+// appendTestMessage appends an unread message with the subject to the mailbox.
+func appendTestMessage(t *testing.T, user *imapmemserver.User, mailbox, from, subject string) {
+	t.Helper()
+
+	raw := strings.ReplaceAll(fmt.Sprintf(`From: %s
+To: jane@acme.com
+Subject: %s
+Date: Mon, 12 Oct 2026 10:00:00 +0000
+Content-Type: text/plain
+
+Hello
+`, from, subject), "\n", "\r\n")
+	_, err := user.Append(mailbox, strings.NewReader(raw), &imap.AppendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mailboxSubjects returns the subjects of the messages in each mailbox.
+func mailboxSubjects(t *testing.T, client *imapclient.Client, mailboxes ...string) map[string][]string {
+	t.Helper()
+
+	subjects := make(map[string][]string, len(mailboxes))
+	for _, mailbox := range mailboxes {
+		data, err := client.Select(mailbox, &imap.SelectOptions{ReadOnly: true}).Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		subjects[mailbox] = []string{}
+		if data.NumMessages == 0 {
+			continue
+		}
+		var seqSet imap.SeqSet
+		seqSet.AddRange(1, data.NumMessages)
+		messages, err := client.Fetch(seqSet, &imap.FetchOptions{Envelope: true}).Collect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range messages {
+			subjects[mailbox] = append(subjects[mailbox], msg.Envelope.Subject)
+		}
+		slices.Sort(subjects[mailbox])
+	}
+	return subjects
+}
+
+func TestProcessMailbox(t *testing.T) {
+	user, endpoint := newTestIMAPServer(t, "jane@acme.com", "secret", "Newsletters", "Bin", "GitHub")
+	appendTestMessage(t, user, "INBOX", "news@vendor.com", "Weekly Newsletter")
+	appendTestMessage(t, user, "INBOX", "spammer@example.com", "Spam offer")
+	appendTestMessage(t, user, "INBOX", "notifications@github.com", "Pull request opened")
+	appendTestMessage(t, user, "INBOX", "joe@acme.com", "Lunch?")
+
+	path := filepath.Join(t.TempDir(), "gmail-blade.yml")
+	err := os.WriteFile(path, []byte(fmt.Sprintf(`
+credentials:
+  username: "jane@acme.com"
+  password: "secret"
+server:
+  imap:
+    host: %q
+    port: %d
+    security: %q
+    trash_mailbox: "Bin"
+filters:
+  - name: "Move newsletters"
+    condition: 'message.subject contains "Newsletter"'
+    actions: ['move to "Newsletters"']
+  - name: "Delete spam"
+    condition: 'message.subject contains "Spam"'
+    actions: [delete]
+  - name: "Label GitHub"
+    condition: '"notifications@github.com" in message.from'
+    actions: ['label "GitHub"']
+`, endpoint.Host, endpoint.Port, endpoint.Security)), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(path, secretResolver{nonInteractive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &config.Accounts[0]
+
+	client, closeClient, err := getAuthenticatedClient(account.IMAP, account.Credentials, &imapclient.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeClient()
+	if client.Caps().Has(gmailCapability) {
+		t.Fatal("test server must not have the Gmail IMAP extensions")
+	}
+
+	logger := log.New(io.Discard)
+	checkpoint := newCheckpoint()
+	err = processMailbox(logger, context.Background(), false, config, account, client, nil, nil, "INBOX", checkpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		// Labels are copies without the Gmail IMAP extensions, so the labeled
+		// message stays in INBOX.
+		"INBOX":       {"Lunch?", "Pull request opened"},
+		"Newsletters": {"Weekly Newsletter"},
+		"Bin":         {"Spam offer"},
+		"GitHub":      {"Pull request opened"},
+	}
+	if got := mailboxSubjects(t, client, "INBOX", "Newsletters", "Bin", "GitHub"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got mailboxes %q, want %q", got, want)
+	}
+	if got := checkpoint.HighestUIDs["INBOX"]; got != 4 {
+		t.Fatalf("got highest processed UID %d, want 4", got)
+	}
+
+	// Messages up to the highest processed UID are not processed again, even
+	// though they are still unread.
+	err = processMailbox(logger, context.Background(), false, config, account, client, nil, nil, "INBOX", checkpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mailboxSubjects(t, client, "GitHub"); len(got["GitHub"]) != 1 {
+		t.Fatalf("got GitHub mailbox %q after processing again, want one message", got["GitHub"])
+	}
+}
+
+func TestProcessMessageMutedThread(t *testing.T) {
+	account := &configAccount{
+		Cache: configCache{CloudflareKV: configCloudflareKV{AccountID: "account", NamespaceID: "namespace", APIToken: "token"}},
+		Filters: []configFilter{
+			{Name: "Mute releases", Condition: `message.subject startsWith "[release]"`, Actions: []configAction{{shorthand: "mute thread"}}},
+			{Name: "Label everything", Condition: `true`, Actions: []configAction{{shorthand: `label "Seen"`}}},
+		},
+	}
+	config := &config{}
+	if err := compileFilters(config, account.Filters); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := newCheckpoint()
+	checkpoint.MutedThreads = []string{"1001"}
+
+	tests := []struct {
+		name    string
+		mailbox string
+		msg     *message
+		dryRun  bool
+		wantLog string
+		wantErr string
+	}{
+		{
+			name:    "muted thread in INBOX",
+			mailbox: "INBOX",
+			msg:     &message{UID: 1, ThreadID: "1001", Subject: "Re: Status"},
+			dryRun:  true,
+			wantLog: "Archiving message of muted thread",
+		},
+		{
+			name:    "muted thread in other mailbox",
+			mailbox: "Projects",
+			msg:     &message{UID: 1, ThreadID: "1001", Subject: "Re: Status"},
+			dryRun:  true,
+			wantLog: `actions="label \"Seen\""`,
+		},
+		{
+			name:    "mute thread without writing the cache",
+			mailbox: "INBOX",
+			msg:     &message{UID: 1, ThreadID: "1002", Subject: "[release] v1.0"},
+			wantErr: `mute thread action cannot be persisted to the cache by backfills and targeted runs`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var logs strings.Builder
+			logger := log.New(&logs)
+			// Neither the IMAP client nor the cache is needed before running actions.
+			err := processMessage(logger, context.Background(), test.dryRun, config, account, nil, nil, nil, checkpoint, test.mailbox, test.msg)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(logs.String(), test.wantLog) {
+				t.Fatalf("got logs %q, want %q", logs.String(), test.wantLog)
+			}
+		})
+	}
+}
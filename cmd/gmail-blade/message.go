@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	gomessage "github.com/emersion/go-message"
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+// messageSection is the entire message, i.e. BODY.PEEK[].
+var messageSection = &imap.FetchItemBodySection{Peek: true}
+
+// messageFetchOptions returns the fetch options for the data needed by
+// newMessage.
+func messageFetchOptions() *imap.FetchOptions {
+	return &imap.FetchOptions{
+		Envelope:     true,
+		Flags:        true,
+		UID:          true,
+		InternalDate: true,
+		RFC822Size:   true,
+		BodySection: []*imap.FetchItemBodySection{
+			messageSection,
+		},
+	}
+}
+
+// message is an email message that filter conditions are evaluated against.
+type message struct {
+	UID       imap.UID
+	From      []string
+	FromName  []string
+	Subject   string
+	Cc        []string
+	To        []string
+	ReplyTo   []string
+	Body      string // The text body, or the text rendering of the HTML body if there is no text body
+	TextBody  string
+	HTMLBody  string
+	HTMLText  string // The text rendering of the HTML body
+	Labels    []string
+	ThreadID  string              // The Gmail thread ID
+	Headers   map[string][]string // Keyed by canonical header names, e.g. "X-Github-Reason"
+	Date      time.Time
+	Size      int64
+	MessageID string
+	InReplyTo []string
+	Flags     []string
+	ListID    string
+
+	Attachments []messageAttachment
+
+	// searchMatches is the set of search queries of filters that the message
+	// matches.
+	searchMatches map[string]bool
+
+	// raw is the entire message as fetched.
+	raw []byte
+}
+
+// messageAttachment is the metadata of an attachment, including inline ones
+// like embedded images.
+type messageAttachment struct {
+	Filename  string
+	MIMEType  string
+	Size      int // The size of the decoded attachment in bytes
+	ContentID string
+	Inline    bool
+}
+
+// attachmentEnv is an attachment in condition expressions.
+type attachmentEnv struct {
+	Filename  string `expr:"filename"`
+	MIMEType  string `expr:"mimeType"`
+	Size      int    `expr:"size"`
+	ContentID string `expr:"contentId"`
+	Inline    bool   `expr:"inline"`
+}
+
+func (a messageAttachment) Env() attachmentEnv {
+	return attachmentEnv{
+		Filename:  a.Filename,
+		MIMEType:  a.MIMEType,
+		Size:      a.Size,
+		ContentID: a.ContentID,
+		Inline:    a.Inline,
+	}
+}
+
+// newMessage builds a message from the data fetched with messageFetchOptions and
+// its Gmail attributes, which are empty without the Gmail IMAP extensions.
+func newMessage(msg *imapclient.FetchMessageBuffer, gmailAttrs gmailAttributes) (*message, error) {
+	raw := msg.FindBodySection(messageSection)
+	m, _, err := parseMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	m.UID = msg.UID
+	m.From = formatAddresses(msg.Envelope.From)
+	m.FromName = make([]string, 0, len(msg.Envelope.From))
+	for _, addr := range msg.Envelope.From {
+		m.FromName = append(m.FromName, addr.Name)
+	}
+	m.Subject = msg.Envelope.Subject
+	m.Cc = formatAddresses(msg.Envelope.Cc)
+	m.To = formatAddresses(msg.Envelope.To)
+	m.ReplyTo = formatAddresses(msg.Envelope.ReplyTo)
+	m.Labels = gmailAttrs.Labels
+	m.ThreadID = gmailAttrs.ThreadID
+	m.Date = msg.Envelope.Date
+	if m.Date.IsZero() {
+		m.Date = msg.InternalDate
+	}
+	m.Size = msg.RFC822Size
+	m.MessageID = msg.Envelope.MessageID
+	m.InReplyTo = msg.Envelope.InReplyTo
+	m.Flags = make([]string, 0, len(msg.Flags))
+	for _, flag := range msg.Flags {
+		m.Flags = append(m.Flags, string(flag))
+	}
+	return m, nil
+}
+
+// newMessageFromRaw builds a message from the raw message, e.g. an .eml file,
+// without an IMAP server. The envelope is parsed from the headers.
+func newMessageFromRaw(uid imap.UID, raw []byte, flags []string) (*message, error) {
+	m, entity, err := parseMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// Malformed headers are treated as missing, the same as IMAP servers do for
+	// the envelope.
+	h := mail.Header{Header: entity.Header}
+	from, _ := h.AddressList("From")
+	cc, _ := h.AddressList("Cc")
+	to, _ := h.AddressList("To")
+	replyTo, _ := h.AddressList("Reply-To")
+
+	m.UID = uid
+	m.From = formatMailAddresses(from)
+	m.FromName = make([]string, 0, len(from))
+	for _, addr := range from {
+		m.FromName = append(m.FromName, addr.Name)
+	}
+	m.Subject = textproto.MIMEHeader(m.Headers).Get("Subject")
+	m.Cc = formatMailAddresses(cc)
+	m.To = formatMailAddresses(to)
+	m.ReplyTo = formatMailAddresses(replyTo)
+	m.Date, _ = h.Date()
+	m.Size = int64(len(raw))
+	m.MessageID, _ = h.MessageID()
+	m.InReplyTo, _ = h.MsgIDList("In-Reply-To")
+	m.Flags = flags
+	if m.Flags == nil {
+		m.Flags = []string{}
+	}
+	return m, nil
+}
+
+// parseMessage parses the raw message and builds the message from it, see
+// buildMessage. It also returns the entity for the envelope.
+func parseMessage(raw []byte) (*message, *gomessage.Entity, error) {
+	entity, err := gomessage.Read(bytes.NewReader(raw))
+	if err != nil && !gomessage.IsUnknownCharset(err) && !gomessage.IsUnknownEncoding(err) {
+		return nil, nil, errors.Wrap(err, "read message")
+	}
+	m, err := buildMessage(entity)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse message")
+	}
+	m.raw = raw
+	return m, entity, nil
+}
+
+// buildMessage builds the message from its entity, i.e. the headers, bodies and
+// attachments, so that messages from the IMAP server, files and filter tests
+// are evaluated the same way. The envelope, flags and Gmail attributes are left
+// to the callers.
+func buildMessage(entity *gomessage.Entity) (*message, error) {
+	headers := entity.Header.Map()
+	for _, values := range headers {
+		for i, value := range values {
+			if decoded, err := headerWordDecoder.DecodeHeader(value); err == nil {
+				values[i] = decoded
+			}
+		}
+	}
+	m := &message{
+		Headers: headers,
+		ListID:  parseListID(textproto.MIMEHeader(headers).Get("List-Id")),
+	}
+
+	// Multiple inline parts of the same type are joined.
+	var textParts, htmlParts []string
+	err := entity.Walk(func(_ []int, part *gomessage.Entity, err error) error {
+		if err != nil && !gomessage.IsUnknownCharset(err) && !gomessage.IsUnknownEncoding(err) {
+			return err
+		}
+		if part.MultipartReader() != nil {
+			return nil
+		}
+
+		disposition, filename, mimeType := partAttributes(part)
+		isBody := disposition != "attachment" && (mimeType == "text/plain" || mimeType == "text/html")
+		isAttachment := isAttachmentPart(disposition, filename, mimeType)
+		if !isBody && !isAttachment {
+			return nil
+		}
+
+		content, err := io.ReadAll(part.Body)
+		if err != nil {
+			return errors.Wrapf(err, "read %s part", mimeType)
+		}
+		if isBody {
+			if mimeType == "text/plain" {
+				textParts = append(textParts, string(content))
+			} else {
+				htmlParts = append(htmlParts, string(content))
+			}
+		}
+		if isAttachment {
+			contentID := part.Header.Get("Content-Id")
+			m.Attachments = append(m.Attachments, messageAttachment{
+				Filename:  filename,
+				MIMEType:  mimeType,
+				Size:      len(content),
+				ContentID: strings.Trim(contentID, "<>"),
+				Inline:    disposition == "inline" || (disposition == "" && contentID != ""),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.TextBody = strings.Join(textParts, "\n")
+	m.HTMLBody = strings.Join(htmlParts, "\n")
+	m.HTMLText = htmlToText(m.HTMLBody)
+	m.Body = m.TextBody
+	if m.Body == "" {
+		m.Body = m.HTMLText
+	}
+	return m, nil
+}
+
+// partAttributes returns the disposition, filename and MIME type of the part,
+// where the filename falls back to the "name" parameter of the content type and
+// the MIME type defaults to "text/plain".
+func partAttributes(part *gomessage.Entity) (disposition, filename, mimeType string) {
+	disposition, dispositionParams, _ := part.Header.ContentDisposition()
+	mimeType, params, _ := part.Header.ContentType()
+	if mimeType == "" {
+		mimeType = "text/plain"
+	}
+	filename = dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if decoded, err := headerWordDecoder.DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+	return disposition, filename, mimeType
+}
+
+// isAttachmentPart returns true if the part is an attachment, i.e. it has a
+// filename or an "attachment" disposition, or is not text, e.g. an embedded
+// image.
+func isAttachmentPart(disposition, filename, mimeType string) bool {
+	return filename != "" || disposition == "attachment" ||
+		(!strings.HasPrefix(mimeType, "text/") && mimeType != "message/rfc822")
+}
+
+// messageEnv is the "message" of condition expressions.
+type messageEnv struct {
+	UID       int                 `expr:"uid"`
+	From      []string            `expr:"from"`
+	FromName  []string            `expr:"fromName"`
+	Subject   string              `expr:"subject"`
+	Cc        []string            `expr:"cc"`
+	To        []string            `expr:"to"`
+	ReplyTo   []string            `expr:"replyTo"`
+	Body      string              `expr:"body"`
+	TextBody  string              `expr:"textBody"`
+	HTMLBody  string              `expr:"htmlBody"`
+	HTMLText  string              `expr:"htmlText"`
+	Labels    []string            `expr:"labels"`
+	ThreadID  string              `expr:"threadId"`
+	Headers   map[string][]string `expr:"headers"`
+	Date      time.Time           `expr:"date"`
+	Size      int                 `expr:"size"`
+	MessageID string              `expr:"messageId"`
+	InReplyTo []string            `expr:"inReplyTo"`
+	Flags     []string            `expr:"flags"`
+	ListID    string              `expr:"listId"`
+
+	Attachments []attachmentEnv `expr:"attachments"`
+}
+
+func (m *message) Env() messageEnv {
+	attachments := make([]attachmentEnv, 0, len(m.Attachments))
+	for _, a := range m.Attachments {
+		attachments = append(attachments, a.Env())
+	}
+	return messageEnv{
+		UID:       int(m.UID),
+		From:      m.From,
+		FromName:  m.FromName,
+		Subject:   m.Subject,
+		Cc:        m.Cc,
+		To:        m.To,
+		ReplyTo:   m.ReplyTo,
+		Body:      m.Body,
+		TextBody:  m.TextBody,
+		HTMLBody:  m.HTMLBody,
+		HTMLText:  m.HTMLText,
+		Labels:    m.Labels,
+		ThreadID:  m.ThreadID,
+		Headers:   m.Headers,
+		Date:      m.Date,
+		Size:      int(m.Size),
+		MessageID: m.MessageID,
+		InReplyTo: m.InReplyTo,
+		Flags:     m.Flags,
+		ListID:    m.ListID,
+
+		Attachments: attachments,
+	}
+}
+
+func formatAddresses(addrs []imap.Address) []string {
+	formatted := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		formatted = append(formatted, fmt.Sprintf("%s@%s", addr.Mailbox, addr.Host))
+	}
+	return formatted
+}
+
+func formatMailAddresses(addrs []*mail.Address) []string {
+	formatted := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		formatted = append(formatted, addr.Address)
+	}
+	return formatted
+}
+
+var headerWordDecoder = &mime.WordDecoder{CharsetReader: charset.Reader}
+
+// parseListID returns the identifier of a List-Id header, e.g. "golang-nuts.googlegroups.com"
+// of "golang-nuts <golang-nuts.googlegroups.com>".
+func parseListID(value string) string {
+	start := strings.LastIndex(value, "<")
+	end := strings.LastIndex(value, ">")
+	if start >= 0 && end > start {
+		return value[start+1 : end]
+	}
+	return strings.TrimSpace(value)
+}
+
+// walkAttachmentContents calls fn with the filename, MIME type and decoded
+// content of every attachment, i.e. parts with an "attachment" disposition or a
+// filename, except named text parts that are displayed inline.
+func (m *message) walkAttachmentContents(fn func(filename, mimeType string, content []byte) error) error {
+	entity, err := gomessage.Read(bytes.NewReader(m.raw))
+	if err != nil && !gomessage.IsUnknownCharset(err) && !gomessage.IsUnknownEncoding(err) {
+		return err
+	}
+
+	return entity.Walk(func(_ []int, part *gomessage.Entity, err error) error {
+		if err != nil && !gomessage.IsUnknownCharset(err) && !gomessage.IsUnknownEncoding(err) {
+			return err
+		}
+		if part.MultipartReader() != nil {
+			return nil
+		}
+
+		disposition, filename, mimeType := partAttributes(part)
+		// Named parts that are not text are saved even when displayed inline,
+		// e.g. PDFs attached by Apple Mail.
+		if disposition != "attachment" && (filename == "" || (disposition != "" && strings.HasPrefix(mimeType, "text/"))) {
+			return nil
+		}
+
+		content, err := io.ReadAll(part.Body)
+		if err != nil {
+			return errors.Wrapf(err, "read attachment %q", filename)
+		}
+		return fn(filename, mimeType, content)
+	})
+}
+
+// htmlToText renders the HTML as plain text, with one line per block element
+// and whitespace collapsed the same way as browsers do.
+func htmlToText(s string) string {
+	if s == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	skipDepth := 0
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			var lines []string
+			for _, line := range strings.Split(b.String(), "\n") {
+				line = strings.Join(strings.Fields(line), " ")
+				if line != "" {
+					lines = append(lines, line)
+				}
+			}
+			return strings.Join(lines, "\n")
+
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style", "head", "title":
+				if tt == html.StartTagToken {
+					skipDepth++
+				} else if tt == html.EndTagToken && skipDepth > 0 {
+					skipDepth--
+				}
+			case "br", "p", "div", "li", "tr", "table", "ul", "ol", "blockquote", "pre",
+				"h1", "h2", "h3", "h4", "h5", "h6", "hr":
+				b.WriteByte('\n')
+			case "td", "th":
+				b.WriteByte(' ')
+			}
+
+		case html.TextToken:
+			if skipDepth > 0 {
+				continue
+			}
+			// Line breaks in the source are just whitespace, the text is split into
+			// lines only by block elements.
+			b.WriteString(strings.Map(func(r rune) rune {
+				if unicode.IsSpace(r) {
+					return ' '
+				}
+				return r
+			}, string(z.Text())))
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-sasl"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+// gmailOAuth2Scope is the OAuth2 scope required for IMAP access to Gmail.
+const gmailOAuth2Scope = "https://mail.google.com/"
+
+// newOAuth2TokenSource returns a token source that refreshes the access token
+// automatically whenever it is expired. When a token file is configured, the
+// token is loaded from and persisted back to it after every refresh.
+func newOAuth2TokenSource(config configOAuth2) (oauth2.TokenSource, error) {
+	oauth2Config := &oauth2.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		Endpoint:     endpoints.Google,
+		Scopes:       []string{gmailOAuth2Scope},
+	}
+	if config.TokenURL != "" {
+		oauth2Config.Endpoint = oauth2.Endpoint{TokenURL: config.TokenURL}
+	}
+
+	token := &oauth2.Token{RefreshToken: config.RefreshToken}
+	if config.TokenFile != "" {
+		data, err := os.ReadFile(config.TokenFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "read token file")
+		}
+		if err == nil {
+			// The token file takes precedence as it holds the most recently issued
+			// (and possibly rotated) refresh token.
+			var fileToken oauth2.Token
+			if err = json.Unmarshal(data, &fileToken); err != nil {
+				return nil, errors.Wrap(err, "decode token file")
+			}
+			if fileToken.RefreshToken == "" {
+				fileToken.RefreshToken = config.RefreshToken
+			}
+			token = &fileToken
+		}
+	}
+	if token.RefreshToken == "" {
+		return nil, errors.New("refresh token cannot be empty")
+	}
+
+	// The token source is used for the lifetime of the process, so it must not
+	// be tied to any request-scoped context.
+	tokenSource := oauth2Config.TokenSource(context.Background(), token)
+	if config.TokenFile == "" {
+		return tokenSource, nil
+	}
+	return &fileTokenSource{
+		path:       config.TokenFile,
+		underlying: tokenSource,
+		last:       token,
+	}, nil
+}
+
+// fileTokenSource wraps a token source and writes every newly issued token to
+// a file, so that refreshed tokens survive restarts.
+type fileTokenSource struct {
+	path       string
+	underlying oauth2.TokenSource
+
+	mu   sync.Mutex
+	last *oauth2.Token
+}
+
+func (s *fileTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, err := s.underlying.Token()
+	if err != nil {
+		return nil, err
+	}
+	if s.last != nil && s.last.AccessToken == token.AccessToken {
+		return token, nil
+	}
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "encode token")
+	}
+	if err = os.WriteFile(s.path, data, 0o600); err != nil {
+		return nil, errors.Wrap(err, "write token file")
+	}
+	s.last = token
+	return token, nil
+}
+
+// xoauth2Client implements the SASL XOAUTH2 mechanism used by Gmail, see
+// https://developers.google.com/workspace/gmail/imap/xoauth2-protocol.
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	return "XOAUTH2", []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"), nil
+}
+
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// The server only sends a challenge, which is a JSON error description, when
+	// the authentication failed.
+	return nil, errors.Errorf("XOAUTH2 authentication error: %s", challenge)
+}
+
+// newOAuth2SASLClient returns a SASL client for the given access token,
+// preferring the standard OAUTHBEARER mechanism over XOAUTH2 when the server
+// advertises it.
+func newOAuth2SASLClient(caps imap.CapSet, username, token string) sasl.Client {
+	if caps.Has(imap.AuthCap(sasl.OAuthBearer)) {
+		return sasl.NewOAuthBearerClient(
+			&sasl.OAuthBearerOptions{
+				Username: username,
+				Token:    token,
+			},
+		)
+	}
+	return &xoauth2Client{
+		username: username,
+		token:    token,
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// jsonSchema is a JSON Schema (draft 7) of a value in the config file.
+type jsonSchema map[string]any
+
+// configSchema returns the JSON Schema of the config file, which is generated
+// from the config structs so that it never gets out of sync with them. It also
+// describes included files, whose fields are a subset of the config.
+func configSchema() jsonSchema {
+	schema := schemaOf(reflect.TypeOf(config{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "gmail-blade config"
+	return schema
+}
+
+// customSchema returns the schema of the type if it is not decoded field by
+// field, e.g. configAction.
+func customSchema(t reflect.Type) (jsonSchema, bool) {
+	switch t {
+	case reflect.TypeOf(configAction{}):
+		return actionSchema(), true
+	case reflect.TypeOf(configDefinition{}):
+		return definitionSchema(), true
+	case reflect.TypeOf(time.Time{}):
+		return jsonSchema{"type": "string"}, true
+	}
+	return nil, false
+}
+
+// fieldSchemas are the schemas of struct fields keyed by the struct type and
+// the YAML name of the field, which override the schemas of their Go types.
+var fieldSchemas = map[reflect.Type]map[string]func() jsonSchema{
+	reflect.TypeOf(configAction{}): {
+		"type": func() jsonSchema {
+			return jsonSchema{
+				"type": "string",
+				"enum": slices.Concat(actionsWithoutArguments, actionsWithArguments),
+			}
+		},
+	},
+	reflect.TypeOf(configFilter{}): {
+		"condition": func() jsonSchema {
+			return jsonSchema{
+				"type":        "string",
+				"description": "The expr-lang/expr expression that evaluates to a boolean, see https://expr-lang.org/",
+			}
+		},
+		"prefetches": func() jsonSchema {
+			return jsonSchema{
+				"type": "array",
+				"items": jsonSchema{
+					"type":    "string",
+					"pattern": caseInsensitivePattern(githubPullRequestRegexp),
+				},
+			}
+		},
+	},
+	reflect.TypeOf(configIMAP{}): {
+		"security": func() jsonSchema {
+			return jsonSchema{
+				"type": "string",
+				"enum": []string{imapSecurityTLS, imapSecurityStartTLS, imapSecurityPlain},
+			}
+		},
+	},
+}
+
+// schemaOf returns the schema of the values of the type, where structs are
+// described by the YAML names of their fields.
+func schemaOf(t reflect.Type) jsonSchema {
+	if custom, ok := customSchema(t); ok {
+		return custom
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem())
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.Slice:
+		return jsonSchema{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	}
+	return jsonSchema{}
+}
+
+// structSchema returns the schema of the struct type, which only allows the
+// fields with YAML names.
+func structSchema(t reflect.Type) jsonSchema {
+	properties := make(map[string]jsonSchema)
+	for name, field := range yamlFields(t) {
+		if override, ok := fieldSchemas[t][name]; ok {
+			properties[name] = override()
+		} else {
+			properties[name] = schemaOf(field.Type)
+		}
+	}
+	return jsonSchema{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// actionSchema returns the schema of an action, which is either the string
+// shorthand or a map, see configAction.
+func actionSchema() jsonSchema {
+	var shorthandsWithArguments []string
+	for _, action := range actionsWithArguments {
+		shorthandsWithArguments = append(shorthandsWithArguments, regexp.QuoteMeta(action))
+	}
+
+	object := structSchema(reflect.TypeOf(configAction{}))
+	object["required"] = []string{"type"}
+
+	return jsonSchema{
+		"anyOf": []jsonSchema{
+			{
+				"type": "string",
+				"enum": actionsWithoutArguments,
+			},
+			{
+				"type":    "string",
+				"pattern": `^(` + strings.Join(shorthandsWithArguments, "|") + `) "[^"]+"$`,
+			},
+			{
+				"type":    "string",
+				"pattern": caseInsensitivePattern(githubReviewRegexp),
+			},
+			object,
+		},
+	}
+}
+
+// definitionSchema returns the schema of a definition, which is either an
+// expression or a constant list, see configDefinition.
+func definitionSchema() jsonSchema {
+	return jsonSchema{
+		"anyOf": []jsonSchema{
+			{
+				"type":        []string{"string", "number", "boolean"},
+				"description": "The expr-lang/expr sub-expression that conditions reference by the name",
+			},
+			{
+				"type":        "array",
+				"description": "The constant list that conditions reference by the name",
+			},
+		},
+	}
+}
+
+// caseInsensitivePattern returns the pattern of the (?i) regular expression in
+// the ECMAScript syntax of JSON Schema, which has no flags, e.g. "[gG][iI]..."
+// for `(?i)gi...`.
+func caseInsensitivePattern(re *regexp.Regexp) string {
+	pattern := strings.TrimPrefix(re.String(), "(?i)")
+	var b strings.Builder
+	escaped := false
+	for _, r := range pattern {
+		if !escaped && unicode.IsLetter(r) && unicode.ToUpper(r) != unicode.ToLower(r) {
+			b.WriteString("[" + string(unicode.ToLower(r)) + string(unicode.ToUpper(r)) + "]")
+		} else {
+			b.WriteRune(r)
+		}
+		escaped = !escaped && r == '\\'
+	}
+	return b.String()
+}
+
+// writeConfigSchema writes the JSON Schema of the config file to w.
+func writeConfigSchema(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(configSchema())
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodedConfigSchema returns the schema as written by writeConfigSchema, so
+// that tests see the same JSON as editors do.
+func decodedConfigSchema(t *testing.T) map[string]any {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := writeConfigSchema(&buf); err != nil {
+		t.Fatalf("write schema: %v", err)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &schema); err != nil {
+		t.Fatalf("decode schema: %v", err)
+	}
+	return schema
+}
+
+func TestConfigSchemaFields(t *testing.T) {
+	checkSchemaFields(t, "config", reflect.TypeOf(config{}), decodedConfigSchema(t))
+}
+
+// checkSchemaFields checks that every field with a YAML name of the type and of
+// the types it contains is in the properties of the matching schema.
+func checkSchemaFields(t *testing.T, path string, typ reflect.Type, schema map[string]any) {
+	t.Helper()
+
+	switch typ {
+	case reflect.TypeOf(configAction{}):
+		// The map form of an action is the object among the shorthands.
+		for _, s := range schema["anyOf"].([]any) {
+			if s := s.(map[string]any); s["type"] == "object" {
+				schema = s
+			}
+		}
+	case reflect.TypeOf(configDefinition{}), reflect.TypeOf(time.Time{}):
+		return
+	}
+
+	switch typ.Kind() {
+	case reflect.Pointer:
+		checkSchemaFields(t, path, typ.Elem(), schema)
+	case reflect.Slice:
+		items, ok := schema["items"].(map[string]any)
+		if !ok {
+			t.Errorf("%s: no items in schema", path)
+			return
+		}
+		checkSchemaFields(t, path+"[]", typ.Elem(), items)
+	case reflect.Map:
+		values, ok := schema["additionalProperties"].(map[string]any)
+		if !ok {
+			t.Errorf("%s: no additionalProperties in schema", path)
+			return
+		}
+		checkSchemaFields(t, path+".*", typ.Elem(), values)
+	case reflect.Struct:
+		properties, _ := schema["properties"].(map[string]any)
+		for name, field := range yamlFields(typ) {
+			property, ok := properties[name].(map[string]any)
+			if !ok {
+				t.Errorf("%s.%s: not in schema", path, name)
+				continue
+			}
+			if _, ok := fieldSchemas[typ][name]; ok {
+				continue
+			}
+			checkSchemaFields(t, path+"."+name, field.Type, property)
+		}
+	}
+}
+
+func TestConfigSchemaREADME(t *testing.T) {
+	readme, err := os.ReadFile("../../README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The example config is the first YAML block of the Configuration section.
+	_, section, _ := strings.Cut(string(readme), "\n### Configuration\n")
+	_, example, ok := strings.Cut(section, "```yaml\n")
+	if !ok {
+		t.Fatal("no example config in README.md")
+	}
+	example, _, _ = strings.Cut(example, "```")
+
+	var value any
+	if err := yaml.Unmarshal([]byte(example), &value); err != nil {
+		t.Fatalf("decode example config: %v", err)
+	}
+	if err := validateSchema(decodedConfigSchema(t), value, "config"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// validateSchema returns an error when the value does not match the schema.
+// It only supports the keywords used by configSchema.
+func validateSchema(schema map[string]any, value any, path string) error {
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		var errs []string
+		for _, s := range anyOf {
+			err := validateSchema(s.(map[string]any), value, path)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("%s: matches none of anyOf: %s", path, strings.Join(errs, "; "))
+	}
+
+	if typ, ok := schema["type"]; ok {
+		types, ok := typ.([]any)
+		if !ok {
+			types = []any{typ}
+		}
+		if !slices.Contains(types, any(schemaType(value))) &&
+			!(schemaType(value) == "integer" && slices.Contains(types, any("number"))) {
+			return fmt.Errorf("%s: got %s, want %v", path, schemaType(value), typ)
+		}
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, value) {
+		return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		if s, ok := value.(string); ok && !regexp.MustCompile(pattern).MatchString(s) {
+			return fmt.Errorf("%s: %q does not match %q", path, s, pattern)
+		}
+	}
+
+	switch value := value.(type) {
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range value {
+				if err := validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		if required, ok := schema["required"].([]any); ok {
+			for _, name := range required {
+				if _, ok := value[name.(string)]; !ok {
+					return fmt.Errorf("%s: missing %s", path, name)
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		for name, v := range value {
+			s, ok := properties[name].(map[string]any)
+			if !ok {
+				switch additional := schema["additionalProperties"].(type) {
+				case bool:
+					if !additional {
+						return fmt.Errorf("%s: unknown field %q", path, name)
+					}
+					continue
+				case map[string]any:
+					s = additional
+				default:
+					continue
+				}
+			}
+			if err := validateSchema(s, v, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// schemaType returns the JSON Schema type of the decoded YAML value.
+func schemaType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case int, int64, uint64:
+		return "integer"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func TestConfigSchemaFile(t *testing.T) {
+	want, err := os.ReadFile("../../gmail-blade.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := writeConfigSchema(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Fatal("gmail-blade.schema.json is out of date, run `go run ./cmd/gmail-blade schema > gmail-blade.schema.json`")
+	}
+}
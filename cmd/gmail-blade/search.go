@@ -0,0 +1,76 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/pkg/errors"
+)
+
+// filterSearchResults is the UIDs found by the search queries of filters, keyed
+// by the query.
+type filterSearchResults struct {
+	matches map[string]map[imap.UID]struct{}
+	// all is true when every filter of the mailbox has a search query, thus a
+	// message not found by any query cannot match any filter.
+	all bool
+}
+
+// searchFilters runs the search queries of filters of the mailbox for messages
+// after the given UID, only unread ones when unseen is true.
+func searchFilters(gmail *gmailClient, account *configAccount, mailbox string, after imap.UID, unseen bool) (*filterSearchResults, error) {
+	results := &filterSearchResults{
+		matches: make(map[string]map[imap.UID]struct{}),
+		all:     true,
+	}
+	for _, f := range account.Filters {
+		if len(f.Mailboxes) > 0 && !slices.Contains(f.Mailboxes, mailbox) {
+			continue
+		}
+		if f.Search == "" {
+			results.all = false
+			continue
+		}
+		if _, ok := results.matches[f.Search]; ok {
+			continue
+		}
+		if gmail == nil {
+			return nil, errors.Errorf("search of filter %q requires an IMAP server with the %s extension", f.Name, gmailCapability)
+		}
+
+		uids, err := gmail.searchRaw(mailbox, after, unseen, f.Search)
+		if err != nil {
+			return nil, errors.Wrapf(err, "search messages of filter %q", f.Name)
+		}
+		matches := make(map[imap.UID]struct{}, len(uids))
+		for _, uid := range uids {
+			matches[uid] = struct{}{}
+		}
+		results.matches[f.Search] = matches
+	}
+	return results, nil
+}
+
+// narrow removes the UIDs that cannot match any filter.
+func (r *filterSearchResults) narrow(uids []imap.UID) []imap.UID {
+	if !r.all || len(r.matches) == 0 {
+		return uids
+	}
+	return slices.DeleteFunc(uids, func(uid imap.UID) bool {
+		return len(r.queries(uid)) == 0
+	})
+}
+
+// queries returns the set of search queries that found the message.
+func (r *filterSearchResults) queries(uid imap.UID) map[string]bool {
+	var queries map[string]bool
+	for query, matches := range r.matches {
+		if _, ok := matches[uid]; ok {
+			if queries == nil {
+				queries = make(map[string]bool)
+			}
+			queries[query] = true
+		}
+	}
+	return queries
+}
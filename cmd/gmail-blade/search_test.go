@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestFilterSearchResultsNarrow(t *testing.T) {
+	matches := map[string]map[imap.UID]struct{}{
+		"from:github.com": {1: {}, 3: {}},
+		"label:jira":      {3: {}, 5: {}},
+	}
+	tests := []struct {
+		name    string
+		results *filterSearchResults
+		want    []imap.UID
+	}{
+		{
+			name:    "all filters have search",
+			results: &filterSearchResults{matches: matches, all: true},
+			want:    []imap.UID{1, 3, 5},
+		},
+		{
+			name:    "some filters have no search",
+			results: &filterSearchResults{matches: matches, all: false},
+			want:    []imap.UID{1, 2, 3, 4, 5, 6},
+		},
+		{
+			name:    "no filters have search",
+			results: &filterSearchResults{matches: map[string]map[imap.UID]struct{}{}, all: true},
+			want:    []imap.UID{1, 2, 3, 4, 5, 6},
+		},
+		{
+			name: "searches found nothing",
+			results: &filterSearchResults{
+				matches: map[string]map[imap.UID]struct{}{"from:github.com": {}},
+				all:     true,
+			},
+			want: []imap.UID{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.results.narrow([]imap.UID{1, 2, 3, 4, 5, 6})
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterSearchResultsQueries(t *testing.T) {
+	results := &filterSearchResults{
+		matches: map[string]map[imap.UID]struct{}{
+			"from:github.com": {1: {}, 3: {}},
+			"label:jira":      {3: {}},
+		},
+	}
+	if got := results.queries(2); got != nil {
+		t.Fatalf("got queries %v for UID not found by any search, want nil", got)
+	}
+	want := map[string]bool{"from:github.com": true, "label:jira": true}
+	if got := results.queries(3); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got queries %v, want %v", got, want)
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	t.Run("all filters have search", func(t *testing.T) {
+		server := newFakeIMAPServer(
+			[2]string{"SELECT ", ""},
+			[2]string{`UID SEARCH UID 11:* UNSEEN X-GM-RAW "from:github.com"`, "* SEARCH 12 14\r\n"},
+			[2]string{`UID SEARCH UID 11:* UNSEEN X-GM-RAW "label:jira"`, "* SEARCH 14 15\r\n"},
+		)
+		gmail := newPipeGmailClient(server)
+		defer func() { _ = gmail.Close() }()
+
+		account := &configAccount{
+			Filters: []configFilter{
+				{Name: "GitHub", Search: "from:github.com"},
+				{Name: "GitHub again", Search: "from:github.com"},
+				{Name: "Jira", Search: "label:jira", Mailboxes: []string{"INBOX"}},
+				// Filters of other mailboxes do not need a search.
+				{Name: "Spam", Mailboxes: []string{"[Gmail]/Spam"}},
+			},
+		}
+		results, err := searchFilters(gmail, account, "INBOX", 10, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !results.all {
+			t.Fatal("got all false, want true")
+		}
+		got := results.narrow([]imap.UID{11, 12, 13, 14, 15, 16})
+		if want := []imap.UID{12, 14, 15}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got narrowed UIDs %v, want %v", got, want)
+		}
+
+		// Queries shared by filters are only sent once.
+		want := []string{
+			`SELECT "INBOX"`,
+			`UID SEARCH UID 11:* UNSEEN X-GM-RAW "from:github.com"`,
+			`UID SEARCH UID 11:* UNSEEN X-GM-RAW "label:jira"`,
+		}
+		if got := server.recorded(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got commands %q, want %q", got, want)
+		}
+	})
+
+	t.Run("some filters have no search", func(t *testing.T) {
+		account := &configAccount{
+			Filters: []configFilter{
+				{Name: "Everything"},
+			},
+		}
+		// No search is sent, so no Gmail connection is needed.
+		results, err := searchFilters(nil, account, "INBOX", 10, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results.all {
+			t.Fatal("got all true, want false")
+		}
+		got := results.narrow([]imap.UID{11, 12})
+		if want := []imap.UID{11, 12}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got narrowed UIDs %v, want %v", got, want)
+		}
+	})
+
+	t.Run("search without Gmail extensions", func(t *testing.T) {
+		account := &configAccount{
+			Filters: []configFilter{
+				{Name: "GitHub", Search: "from:github.com"},
+			},
+		}
+		_, err := searchFilters(nil, account, "INBOX", 10, true)
+		if err == nil {
+			t.Fatal("got no error, want an error about the missing extension")
+		}
+	})
+}
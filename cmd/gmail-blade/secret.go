@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+)
+
+// Prefixes of secrets that are read from elsewhere than the config file.
+const (
+	// secretFilePrefix reads the secret from the file, e.g.
+	// "file:/run/secrets/gmail_password".
+	secretFilePrefix = "file:"
+	// secretExecPrefix reads the secret from the output of the shell command,
+	// e.g. "exec:pass show gmail".
+	secretExecPrefix = "exec:"
+)
+
+// secretCommandTimeout bounds the commands of secretExecPrefix, so that a
+// password manager waiting for input cannot block loading the config forever,
+// e.g. when reloading the config of a running server.
+const secretCommandTimeout = time.Minute
+
+// secretResolver resolves the secrets of the config, i.e. passwords and tokens.
+type secretResolver struct {
+	// disabled leaves secrets as written in the config file and never prompts
+	// for empty ones, e.g. to validate the config without access to them.
+	disabled bool
+	// nonInteractive fails for empty secrets instead of prompting for them, e.g.
+	// when reloading the config of a running server.
+	nonInteractive bool
+	// resolved memoizes the values of resolved secrets by their references in
+	// the config file, so that secrets shared by accounts, e.g. the Cloudflare
+	// API token, are read and their commands run once per load of the config.
+	// Secrets are not memoized when it is nil.
+	resolved map[string]string
+}
+
+// resolve returns the value of the secret, which is either read from a file
+// with secretFilePrefix, the output of a command with secretExecPrefix, or the
+// secret itself with environment variables expanded. Trailing newlines of files
+// and outputs are removed.
+func (r secretResolver) resolve(secret string) (string, error) {
+	if r.disabled {
+		return secret, nil
+	}
+	if value, ok := r.resolved[secret]; ok {
+		return value, nil
+	}
+
+	value, err := r.resolveUncached(secret)
+	if err != nil {
+		return "", err
+	}
+	if r.resolved != nil {
+		r.resolved[secret] = value
+	}
+	return value, nil
+}
+
+// resolveUncached returns the value of the secret without memoizing it, see
+// resolve.
+func (r secretResolver) resolveUncached(secret string) (string, error) {
+	if path, ok := strings.CutPrefix(secret, secretFilePrefix); ok {
+		// Allow paths like "$CREDENTIALS_DIRECTORY/gmail_password" of systemd.
+		data, err := os.ReadFile(os.ExpandEnv(path))
+		if err != nil {
+			return "", errors.Wrap(err, "read secret file")
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if command, ok := strings.CutPrefix(secret, secretExecPrefix); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		// Do not wait for children of the shell that keep the output open.
+		cmd.WaitDelay = time.Second
+		var stderr bytes.Buffer
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+		output, err := cmd.Output()
+		if ctx.Err() != nil {
+			err = errors.Errorf("timed out after %s", secretCommandTimeout)
+		}
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				err = errors.Errorf("%v: %s", err, msg)
+			}
+			return "", errors.Wrapf(err, "run secret command %q", command)
+		}
+		return strings.TrimRight(string(output), "\r\n"), nil
+	}
+	return os.ExpandEnv(secret), nil
+}
+
+// prompt reads the secret from the terminal with the prompt when the secret is
+// empty.
+func (r secretResolver) prompt(secret *string, prompt string) error {
+	if *secret != "" || r.disabled {
+		return nil
+	}
+	if r.nonInteractive {
+		return errors.New("empty secret cannot be prompted for")
+	}
+
+	fmt.Print(prompt)
+	value, err := term.ReadPassword(syscall.Stdin)
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	*secret = string(value)
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/pkg/errors"
+)
+
+// rawMessage is a message read from a file for simulation.
+type rawMessage struct {
+	source string // The file path, with the 1-based index of the message in mbox files, e.g. "archive.mbox:3"
+	raw    []byte
+	flags  []string
+}
+
+// readRawMessages reads the messages of the path, which is either an .eml file,
+// an mbox file, a Maildir, or a directory of .eml files.
+func readRawMessages(path string) ([]rawMessage, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(data, []byte("From ")) {
+			return splitMbox(path, data), nil
+		}
+		return []rawMessage{{source: path, raw: data}}, nil
+	}
+
+	if isMaildir(path) {
+		return readMaildir(path)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var messages []rawMessage
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".eml") {
+			continue
+		}
+		name := filepath.Join(path, entry.Name())
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, rawMessage{source: name, raw: data})
+	}
+	return messages, nil
+}
+
+func isMaildir(path string) bool {
+	for _, dir := range []string{"cur", "new"} {
+		if fi, err := os.Stat(filepath.Join(path, dir)); err == nil && fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// maildirFlags maps the flags in Maildir filenames to IMAP flags, see
+// https://cr.yp.to/proto/maildir.html.
+var maildirFlags = map[rune]imap.Flag{
+	'D': imap.FlagDraft,
+	'F': imap.FlagFlagged,
+	'R': imap.FlagAnswered,
+	'S': imap.FlagSeen,
+	'T': imap.FlagDeleted,
+}
+
+// readMaildir reads the messages in the "new" and "cur" directories of the
+// Maildir, with flags parsed from the filenames, e.g. "1712.M1P2.host:2,FS".
+func readMaildir(path string) ([]rawMessage, error) {
+	var messages []rawMessage
+	for _, dir := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(path, dir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			name := filepath.Join(path, dir, entry.Name())
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return nil, err
+			}
+
+			var flags []string
+			if _, info, ok := strings.Cut(entry.Name(), ":2,"); ok {
+				for _, r := range info {
+					if flag, ok := maildirFlags[r]; ok {
+						flags = append(flags, string(flag))
+					}
+				}
+			}
+			messages = append(messages, rawMessage{source: name, raw: data, flags: flags})
+		}
+	}
+	return messages, nil
+}
+
+// splitMbox splits the mbox file into messages. Each message starts with a
+// "From " line at the start of the file or after an empty line, and ">From "
+// lines in the body are unescaped as in the mboxrd format.
+func splitMbox(path string, data []byte) []rawMessage {
+	var messages []rawMessage
+	var current *bytes.Buffer
+	// Whether the previous line is empty, which "From " lines must follow.
+	prevEmpty := true
+	flush := func() {
+		if current == nil {
+			return
+		}
+		// The empty line before the next "From " line (or at the end of the file)
+		// is not part of the message.
+		raw := current.Bytes()
+		if prevEmpty {
+			raw = bytes.TrimSuffix(raw, []byte("\n"))
+			raw = bytes.TrimSuffix(raw, []byte("\r"))
+		}
+		messages = append(messages, rawMessage{
+			source: path + ":" + strconv.Itoa(len(messages)+1),
+			raw:    raw,
+		})
+	}
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if prevEmpty && bytes.HasPrefix(line, []byte("From ")) {
+				flush()
+				current = &bytes.Buffer{}
+			} else if current != nil {
+				if unescaped := bytes.TrimLeft(line, ">"); len(unescaped) < len(line) && bytes.HasPrefix(unescaped, []byte("From ")) {
+					line = line[1:]
+				}
+				current.Write(line)
+			}
+			prevEmpty = len(bytes.TrimRight(line, "\r\n")) == 0
+		}
+		if err != nil {
+			break
+		}
+	}
+	flush()
+	return messages
+}
+
+// runSimulate evaluates the filters of the account that apply to the mailbox
+// against the messages in the paths, and writes the matched filters and the
+// actions that would run to w without connecting to any IMAP server.
+func runSimulate(logger Logger, ctx context.Context, w io.Writer, config *config, account *configAccount, mailbox string, paths []string) error {
+	if slices.ContainsFunc(account.Filters, func(f configFilter) bool { return f.Search != "" }) {
+		logger.Warn("Filters with a search query never match in simulation as it requires Gmail")
+	}
+
+	var uid imap.UID
+	for _, path := range paths {
+		messages, err := readRawMessages(path)
+		if err != nil {
+			return errors.Wrapf(err, "read %q", path)
+		}
+
+		for _, rawMsg := range messages {
+			uid++
+			msg, err := newMessageFromRaw(uid, rawMsg.raw, rawMsg.flags)
+			if err != nil {
+				return errors.Wrapf(err, "parse %q", rawMsg.source)
+			}
+
+			result := evaluate(logger, ctx, config, account, mailbox, msg, true)
+			_, _ = fmt.Fprintf(w, "%s: %q\n", rawMsg.source, msg.Subject)
+			if len(result.matched) == 0 {
+				_, _ = fmt.Fprintln(w, "  No filters matched")
+				continue
+			}
+			for _, f := range result.matched {
+				_, _ = fmt.Fprintf(w, "  Matched filter %q\n", f.Name)
+			}
+			if len(result.actions) > 0 {
+				actionNames := make([]string, len(result.actions))
+				for i, action := range result.actions {
+					actionNames[i] = action.String()
+				}
+				_, _ = fmt.Fprintf(w, "  Actions: %s\n", strings.Join(actionNames, ", "))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSplitMbox(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{
+			name: "messages",
+			data: "From a@x.com Mon Oct 12 10:00:00 2026\nSubject: A\n\nHello\n\n" +
+				"From b@x.com Mon Oct 12 11:00:00 2026\nSubject: B\n\nWorld\n\n",
+			want: []string{"Subject: A\n\nHello\n", "Subject: B\n\nWorld\n"},
+		},
+		{
+			name: "From line in a paragraph of the body",
+			data: "From a@x.com Mon Oct 12 10:00:00 2026\nSubject: A\n\nQuoted:\nFrom here on\n\n",
+			want: []string{"Subject: A\n\nQuoted:\nFrom here on\n"},
+		},
+		{
+			name: "escaped From lines",
+			data: "From a@x.com Mon Oct 12 10:00:00 2026\nSubject: A\n\n>From the start\n>>From quoted\n>Not From\n\n",
+			want: []string{"Subject: A\n\nFrom the start\n>From quoted\n>Not From\n"},
+		},
+		{
+			name: "CRLF",
+			data: "From a@x.com Mon Oct 12 10:00:00 2026\r\nSubject: A\r\n\r\nHello\r\n\r\n" +
+				"From b@x.com Mon Oct 12 11:00:00 2026\r\nSubject: B\r\n\r\n>From World\r\n\r\n",
+			want: []string{"Subject: A\r\n\r\nHello\r\n", "Subject: B\r\n\r\nFrom World\r\n"},
+		},
+		{
+			name: "no empty line at the end",
+			data: "From a@x.com Mon Oct 12 10:00:00 2026\nSubject: A\n\nHello\n",
+			want: []string{"Subject: A\n\nHello\n"},
+		},
+		{
+			name: "no newline at the end",
+			data: "From a@x.com Mon Oct 12 10:00:00 2026\nSubject: A\n\nHello",
+			want: []string{"Subject: A\n\nHello"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for i, msg := range splitMbox("archive.mbox", []byte(test.data)) {
+				if want := "archive.mbox:" + strconv.Itoa(i+1); msg.source != want {
+					t.Errorf("got source %q, want %q", msg.source, want)
+				}
+				got = append(got, string(msg.raw))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadMaildir(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"new/1712.M1P1.host":       "Subject: New\n\n",
+		"cur/1712.M2P1.host:2,FS":  "Subject: Starred and read\n\n",
+		"cur/1712.M3P1.host:2,":    "Subject: Unread\n\n",
+		"cur/1712.M4P1.host:2,RTx": "Subject: Answered and deleted\n\n",
+		"cur/.hidden":              "Subject: Hidden\n\n",
+		"tmp/1712.M5P1.host":       "Subject: Being delivered\n\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages, err := readRawMessages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		source string
+		raw    string
+		flags  []string
+	}
+	var got []result
+	for _, msg := range messages {
+		source, _ := filepath.Rel(dir, msg.source)
+		got = append(got, result{source: source, raw: string(msg.raw), flags: msg.flags})
+	}
+	want := []result{
+		{source: "new/1712.M1P1.host", raw: "Subject: New\n\n"},
+		{source: "cur/1712.M2P1.host:2,FS", raw: "Subject: Starred and read\n\n", flags: []string{`\Flagged`, `\Seen`}},
+		{source: "cur/1712.M3P1.host:2,", raw: "Subject: Unread\n\n"},
+		{source: "cur/1712.M4P1.host:2,RTx", raw: "Subject: Answered and deleted\n\n", flags: []string{`\Answered`, `\Deleted`}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestReadRawMessages(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.eml":        "Subject: A\n\n",
+		"B.EML":        "Subject: B\n\n",
+		"notes.txt":    "Not a message",
+		"archive.mbox": "From a@x.com Mon Oct 12 10:00:00 2026\nSubject: C\n\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{path: dir, want: []string{"B.EML", "a.eml"}},
+		{path: filepath.Join(dir, "a.eml"), want: []string{"a.eml"}},
+		{path: filepath.Join(dir, "archive.mbox"), want: []string{"archive.mbox:1"}},
+	}
+	for _, test := range tests {
+		messages, err := readRawMessages(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, msg := range messages {
+			got = append(got, filepath.Base(msg.source))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("readRawMessages(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
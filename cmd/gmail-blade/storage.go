@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// s3PathPrefix is the prefix of attachment path templates that are saved to the
+// configured S3-compatible storage, e.g. "s3://bucket/invoices/{{.Filename}}".
+const s3PathPrefix = "s3://"
+
+// attachmentPathData is the data available to attachment path templates.
+type attachmentPathData struct {
+	Mailbox      string
+	UID          uint32
+	Sender       string // The first from address, e.g. "billing@vendor.com"
+	SenderDomain string // The domain of the sender, e.g. "vendor.com"
+	Subject      string
+	Date         string // The date of the message in "2006-01-02" format
+	Year         string
+	Month        string
+	Day          string
+	Filename     string
+}
+
+// newAttachmentPathData returns the template data for the attachment of the
+// message. All values are sanitized to be safe as a single path segment.
+func newAttachmentPathData(mailbox string, msg *message, filename string) attachmentPathData {
+	var sender, senderDomain string
+	if len(msg.From) > 0 {
+		sender = msg.From[0]
+		_, senderDomain, _ = strings.Cut(sender, "@")
+	}
+	date := msg.Date.UTC()
+	return attachmentPathData{
+		Mailbox:      sanitizePathSegment(mailbox),
+		UID:          uint32(msg.UID),
+		Sender:       sanitizePathSegment(sender),
+		SenderDomain: sanitizePathSegment(senderDomain),
+		Subject:      sanitizePathSegment(msg.Subject),
+		Date:         date.Format("2006-01-02"),
+		Year:         date.Format("2006"),
+		Month:        date.Format("01"),
+		Day:          date.Format("02"),
+		Filename:     sanitizePathSegment(filename),
+	}
+}
+
+// sanitizePathSegment replaces path separators and control characters, so that
+// values from the message cannot escape the configured directory.
+func sanitizePathSegment(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// renderAttachmentPath executes the template and returns the cleaned path,
+// where relative local paths are resolved against dir.
+func renderAttachmentPath(tmpl *template.Template, dir string, data attachmentPathData) (string, error) {
+	var b strings.Builder
+	err := tmpl.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	rendered := b.String()
+	if key, ok := strings.CutPrefix(rendered, s3PathPrefix); ok {
+		bucket, key, _ := strings.Cut(key, "/")
+		key = strings.TrimPrefix(path.Clean("/"+key), "/")
+		if bucket == "" || key == "" {
+			return "", errors.Errorf("invalid S3 path %q", rendered)
+		}
+		return s3PathPrefix + bucket + "/" + key, nil
+	}
+	if !filepath.IsAbs(rendered) {
+		return filepath.Join(dir, rendered), nil
+	}
+	return filepath.Clean(rendered), nil
+}
+
+// saveAttachment writes the attachment content to the local path, or to the
+// S3-compatible storage when the path starts with "s3://", and returns the path
+// written. Existing files are never overwritten, a numeric suffix is added to
+// the path instead, e.g. "invoice-2.pdf".
+func saveAttachment(ctx context.Context, storage configStorage, dst string, content []byte, contentType string) (string, error) {
+	if key, ok := strings.CutPrefix(dst, s3PathPrefix); ok {
+		bucket, key, _ := strings.Cut(key, "/")
+		client := newS3Client(storage.S3)
+		for n := 1; ; n++ {
+			suffixed := suffixPath(key, path.Ext(key), n)
+			err := client.putObject(ctx, bucket, suffixed, content, contentType)
+			if errors.Is(err, errObjectExists) {
+				continue
+			}
+			return s3PathPrefix + bucket + "/" + suffixed, err
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(dst), 0o755)
+	if err != nil {
+		return "", errors.Wrap(err, "create directory")
+	}
+	for n := 1; ; n++ {
+		suffixed := suffixPath(dst, filepath.Ext(dst), n)
+		f, err := os.OpenFile(suffixed, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		_, err = f.Write(content)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return suffixed, err
+	}
+}
+
+// suffixPath returns the path with "-n" added before the extension, or the path
+// itself when n is 1.
+func suffixPath(p, ext string, n int) string {
+	if n == 1 {
+		return p
+	}
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(p, ext), n, ext)
+}
+
+// s3Client is a minimal client for S3-compatible storages like AWS S3 and
+// MinIO, which signs requests with AWS Signature Version 4.
+type s3Client struct {
+	endpoint        *url.URL
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	pathStyle       bool
+	httpClient      *http.Client
+}
+
+func newS3Client(config configS3) *s3Client {
+	// The endpoint is validated when parsing the config.
+	endpoint, _ := url.Parse(config.Endpoint)
+	return &s3Client{
+		endpoint:        endpoint,
+		region:          config.Region,
+		accessKeyID:     config.AccessKeyID,
+		secretAccessKey: config.SecretAccessKey,
+		pathStyle:       config.PathStyle,
+		httpClient:      &http.Client{Timeout: time.Minute},
+	}
+}
+
+// errObjectExists is returned by putObject when the object already exists.
+var errObjectExists = errors.New("object already exists")
+
+// putObject creates the object unless it already exists, using a conditional
+// write so that concurrent writers cannot overwrite each other either.
+func (c *s3Client) putObject(ctx context.Context, bucket, key string, content []byte, contentType string) error {
+	objectURL := *c.endpoint
+	if c.pathStyle {
+		objectURL.Path = "/" + bucket + "/" + key
+	} else {
+		objectURL.Host = bucket + "." + objectURL.Host
+		objectURL.Path = "/" + key
+	}
+	objectURL.RawPath = s3EscapePath(objectURL.Path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL.String(), bytes.NewReader(content))
+	if err != nil {
+		return errors.Wrap(err, "create request")
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("If-None-Match", "*")
+	c.sign(req, content, time.Now().UTC())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "send request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return errObjectExists
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err != nil {
+			return errors.Wrapf(err, "read response with status %s", resp.Status)
+		}
+		return errors.Errorf("unexpected response status %s: %s", resp.Status, body)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// sign adds the AWS Signature Version 4 authorization to the request, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html.
+func (c *s3Client) sign(req *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Every header set so far is signed, e.g. Content-Type and If-None-Match, in
+	// the order of their lowercase names.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := slices.Sorted(maps.Keys(headers))
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join(
+		[]string{
+			req.Method,
+			req.URL.EscapedPath(),
+			"", // No query string
+			canonicalHeaders.String(),
+			signedHeaders,
+			payloadHash,
+		},
+		"\n",
+	)
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretAccessKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set(
+		"Authorization",
+		fmt.Sprintf(
+			"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+			c.accessKeyID, scope, signedHeaders, signature,
+		),
+	)
+}
+
+// s3EscapePath escapes every byte of the path except unreserved characters and
+// slashes, as required for canonical requests.
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
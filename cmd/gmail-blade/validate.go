@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// decodeConfigFile decodes the YAML data of the config file at path into v.
+// Unlike yaml.Unmarshal, keys that are not fields of v are rejected, and errors
+// have the position in the file, e.g. "gmail-blade.yml:12:5: ...".
+func decodeConfigFile(path string, data []byte, v any) error {
+	var node yaml.Node
+	err := yaml.Unmarshal(data, &node)
+	if err != nil {
+		return yamlError(path, err)
+	}
+	if node.Kind == 0 {
+		return nil // An empty file
+	}
+
+	err = checkKnownFields(path, &node, reflect.TypeOf(v))
+	if err != nil {
+		return err
+	}
+	err = node.Decode(v)
+	if err != nil {
+		return yamlError(path, err)
+	}
+	return nil
+}
+
+var yamlLineRegexp = regexp.MustCompile(`^(?:yaml: )?line (\d+): `)
+
+// yamlError prefixes the messages of the YAML error with the path instead of
+// "yaml: line N: ", e.g. "gmail-blade.yml:12: ...".
+func yamlError(path string, err error) error {
+	var messages []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+	for i, message := range messages {
+		if match := yamlLineRegexp.FindStringSubmatch(message); match != nil {
+			messages[i] = path + ":" + match[1] + ": " + message[len(match[0]):]
+		} else {
+			messages[i] = path + ": " + message
+		}
+	}
+	return errors.New(strings.Join(messages, "\n"))
+}
+
+// checkKnownFields returns an error for the first key of the mappings in the
+// node that is not a field of the type, e.g. "halt_on_match" instead of
+// "halt-on-match". Nodes of other kinds than the type expects are left to the
+// decoder to report.
+func checkKnownFields(path string, node *yaml.Node, t reflect.Type) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, content := range node.Content {
+			err := checkKnownFields(path, content, t)
+			if err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		for _, content := range node.Content {
+			err := checkKnownFields(path, content, t.Elem())
+			if err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		switch t.Kind() {
+		case reflect.Map:
+			for i := 1; i < len(node.Content); i += 2 {
+				err := checkKnownFields(path, node.Content[i], t.Elem())
+				if err != nil {
+					return err
+				}
+			}
+		case reflect.Struct:
+			// Structs without YAML fields are decoded by themselves, e.g.
+			// configDefinition and time.Time.
+			fields := yamlFields(t)
+			if len(fields) == 0 {
+				return nil
+			}
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i], node.Content[i+1]
+				if key.Value == "<<" {
+					continue // Merge keys of anchors, which are checked where they are defined
+				}
+
+				field, ok := fields[key.Value]
+				if !ok {
+					message := fmt.Sprintf("%s:%d:%d: unknown field %q", path, key.Line, key.Column, key.Value)
+					normalize := strings.NewReplacer("-", "", "_", "").Replace
+					for _, name := range slices.Sorted(maps.Keys(fields)) {
+						if strings.EqualFold(normalize(name), normalize(key.Value)) {
+							message += fmt.Sprintf(", did you mean %q?", name)
+							break
+						}
+					}
+					return errors.New(message)
+				}
+				err := checkKnownFields(path, value, field.Type)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// yamlFields returns the fields of the struct type keyed by their YAML names.
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		} else if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+// checkDuplicateFilters returns an error when more than one of the filters has
+// the same name, as names identify filters in logs, tests and explanations.
+func checkDuplicateFilters(filters []configFilter) error {
+	positions := make(map[string]string, len(filters))
+	for _, f := range filters {
+		if position, ok := positions[f.Name]; ok {
+			return errors.Errorf("%s: filter %q is already defined at %s", f.position(), f.Name, position)
+		}
+		positions[f.Name] = f.position()
+	}
+	return nil
+}
+
+// checkMailboxesExist checks that the mailboxes of the account, including the
+// ones used by actions and labels, exist on the IMAP server of the account.
+func checkMailboxesExist(account *configAccount) error {
+	client, closeClient, err := getAuthenticatedClient(account.IMAP, account.Credentials, &imapclient.Options{})
+	if err != nil {
+		return errors.Wrap(err, "get authenticated IMAP client")
+	}
+	defer closeClient()
+
+	mailboxList, err := client.List("", "*", nil).Collect()
+	if err != nil {
+		return errors.Wrap(err, "list mailboxes")
+	}
+	exists := make(map[string]bool, len(mailboxList))
+	for _, mailbox := range mailboxList {
+		exists[mailbox.Mailbox] = true
+	}
+	// Gmail system labels are not mailboxes, e.g. "\Important", and "INBOX" is
+	// case-insensitive.
+	check := func(mailbox string) bool {
+		return exists[mailbox] || strings.HasPrefix(mailbox, `\`) || strings.EqualFold(mailbox, "INBOX")
+	}
+
+	for _, mailbox := range account.Mailboxes {
+		if !check(mailbox) {
+			return errors.Errorf("mailbox %q does not exist", mailbox)
+		}
+	}
+
+	_, hasGmail := client.Caps()[gmailCapability]
+	for _, f := range account.Filters {
+		for _, action := range f.Actions {
+			var mailbox string
+			switch action.Type {
+			case actionLabel, actionUnlabel:
+				mailbox = action.Name
+			case actionMoveTo:
+				mailbox = action.Mailbox
+			case actionDelete:
+				mailbox = account.IMAP.TrashMailbox
+			case actionArchive:
+				// Gmail archives by removing the "\Inbox" label instead.
+				if hasGmail {
+					continue
+				}
+				mailbox = account.IMAP.ArchiveMailbox
+			case actionArchiveThread, actionMuteThread:
+				// Messages of the thread are always searched and unlabeled in the
+				// archive mailbox, whose name is localized by Gmail.
+				mailbox = account.IMAP.ArchiveMailbox
+			default:
+				continue
+			}
+			if !check(mailbox) {
+				return errors.Errorf("%s: mailbox %q used by filter %q does not exist", f.position(), mailbox, f.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// runValidate checks the mailboxes of the accounts exist when checkMailboxes is
+// true, and writes the summary of the valid config to w. The config itself is
+// validated when it is parsed.
+func runValidate(w io.Writer, path string, config *config, checkMailboxes bool) error {
+	if checkMailboxes {
+		for i := range config.Accounts {
+			account := &config.Accounts[i]
+			err := checkMailboxesExist(account)
+			if err != nil {
+				return errors.Wrapf(err, "account %q", account.Name)
+			}
+		}
+	}
+
+	_, _ = fmt.Fprintf(w, "%s is valid\n", path)
+	return nil
+}